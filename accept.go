@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+)
+
+// rejectionReport is written where the derivatives would have gone when an
+// upload is refused, so the site can tell "rejected" from "still processing".
+const rejectionReport = "rejected.json"
+
+// acceptRules are the editorial minimums an upload must meet. They are
+// evaluated on the oriented image, so a portrait phone photo is judged as a
+// portrait. A zero field disables that rule.
+type acceptRules struct {
+	minWidth  int
+	minHeight int
+	maxAspect float64 // long side / short side
+
+	// minSharpness gates on QualityScores.Sharpness. Unlike the rules above
+	// it needs the resize chain, so it is checked after processImage.
+	minSharpness float64
+}
+
+// loadRules reads MIN_WIDTH, MIN_HEIGHT, MAX_ASPECT and MIN_SHARPNESS. All are
+// off by default, which keeps the previous publish-everything behaviour.
+func loadRules() (acceptRules, error) {
+	var r acceptRules
+	var err error
+	if r.minWidth, err = envInt("MIN_WIDTH", 0); err != nil {
+		return r, err
+	}
+	if r.minHeight, err = envInt("MIN_HEIGHT", 0); err != nil {
+		return r, err
+	}
+	if raw := os.Getenv("MAX_ASPECT"); raw != "" {
+		if r.maxAspect, err = strconv.ParseFloat(raw, 64); err != nil || r.maxAspect < 1 {
+			return r, fmt.Errorf("MAX_ASPECT: invalid value %q (want a ratio >= 1, e.g. 2.5)", raw)
+		}
+	}
+	if raw := os.Getenv("MIN_SHARPNESS"); raw != "" {
+		if r.minSharpness, err = strconv.ParseFloat(raw, 64); err != nil || r.minSharpness < 0 {
+			return r, fmt.Errorf("MIN_SHARPNESS: invalid value %q", raw)
+		}
+	}
+	return r, nil
+}
+
+// Rejection is a structured refusal of an upload that decoded fine but does
+// not meet acceptRules. It is both the error returned to the caller and the
+// body of rejected.json.
+type Rejection struct {
+	Source  string  `json:"source"`
+	Reason  string  `json:"reason"` // machine-readable: "too_small", "aspect_ratio", "blurry"
+	Message string  `json:"message"`
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Aspect  float64 `json:"aspect,omitempty"`
+
+	MinWidth  int     `json:"minWidth,omitempty"`
+	MinHeight int     `json:"minHeight,omitempty"`
+	MaxAspect float64 `json:"maxAspect,omitempty"`
+
+	Sharpness    float64 `json:"sharpness,omitempty"`
+	MinSharpness float64 `json:"minSharpness,omitempty"`
+}
+
+func (r *Rejection) Error() string {
+	return "rejected: " + r.Message
+}
+
+// JSON renders the report. Marshalling a struct of plain fields cannot fail.
+func (r *Rejection) JSON() []byte {
+	b, _ := json.MarshalIndent(r, "", "  ")
+	return append(b, '\n')
+}
+
+// checkAcceptance returns nil if img meets the rules, or a Rejection saying
+// which one it broke. source is only used to label the report.
+func checkAcceptance(img image.Image, rules acceptRules, source string) *Rejection {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	r := &Rejection{Source: source, Width: w, Height: h}
+
+	if w < rules.minWidth || h < rules.minHeight {
+		r.Reason = "too_small"
+		r.MinWidth, r.MinHeight = rules.minWidth, rules.minHeight
+		r.Message = fmt.Sprintf("image is %dx%d, minimum is %dx%d", w, h, rules.minWidth, rules.minHeight)
+		return r
+	}
+	if rules.maxAspect > 0 && w > 0 && h > 0 {
+		aspect := float64(max(w, h)) / float64(min(w, h))
+		if aspect > rules.maxAspect {
+			r.Reason = "aspect_ratio"
+			r.Aspect = roundTo(aspect, 2)
+			r.MaxAspect = rules.maxAspect
+			r.Message = fmt.Sprintf("image is %dx%d, aspect ratio %.2f exceeds %.2f", w, h, aspect, rules.maxAspect)
+			return r
+		}
+	}
+	return nil
+}
+
+// roundTo rounds f to the given number of decimal places, for reports that
+// should read 2.67 rather than 2.6666666666666665.
+func roundTo(f float64, places int) float64 {
+	p := 1.0
+	for i := 0; i < places; i++ {
+		p *= 10
+	}
+	return float64(roundFloat(f*p)) / p
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"testing"
+)
+
+func TestCheckAcceptance(t *testing.T) {
+	tests := []struct {
+		name       string
+		w, h       int
+		rules      acceptRules
+		wantReason string
+	}{
+		{"no rules", 200, 150, acceptRules{}, ""},
+		{"meets minimums", 1200, 900, acceptRules{minWidth: 800, minHeight: 600}, ""},
+		{"screenshot too small", 200, 150, acceptRules{minWidth: 800, minHeight: 600}, "too_small"},
+		{"width only", 799, 2000, acceptRules{minWidth: 800}, "too_small"},
+		// Judged after orientation, so a portrait is narrow, not short.
+		{"portrait fails min width", 600, 800, acceptRules{minWidth: 800, minHeight: 600}, "too_small"},
+		{"aspect ok", 1600, 900, acceptRules{maxAspect: 2}, ""},
+		{"panorama", 3000, 800, acceptRules{maxAspect: 2.5}, "aspect_ratio"},
+		{"tall strip", 500, 2000, acceptRules{maxAspect: 2.5}, "aspect_ratio"},
+		{"exactly the limit", 2000, 1000, acceptRules{maxAspect: 2}, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			img := image.NewRGBA(image.Rect(0, 0, tc.w, tc.h))
+			rej := checkAcceptance(img, tc.rules, "a/b.jpg")
+			if tc.wantReason == "" {
+				if rej != nil {
+					t.Fatalf("rejected: %v", rej)
+				}
+				return
+			}
+			if rej == nil {
+				t.Fatalf("accepted, want rejection %q", tc.wantReason)
+			}
+			if rej.Reason != tc.wantReason {
+				t.Errorf("reason %q, want %q", rej.Reason, tc.wantReason)
+			}
+			if rej.Width != tc.w || rej.Height != tc.h || rej.Source != "a/b.jpg" {
+				t.Errorf("report %+v does not describe the input", rej)
+			}
+		})
+	}
+}
+
+func TestRejectionJSON(t *testing.T) {
+	rej := checkAcceptance(image.NewRGBA(image.Rect(0, 0, 200, 150)), acceptRules{minWidth: 800, minHeight: 600}, "a/b.jpg")
+	var got map[string]any
+	if err := json.Unmarshal(rej.JSON(), &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"source", "reason", "message", "width", "height", "minWidth", "minHeight"} {
+		if _, ok := got[field]; !ok {
+			t.Errorf("report has no %q field: %s", field, rej.JSON())
+		}
+	}
+	if _, ok := got["maxAspect"]; ok {
+		t.Error("report includes maxAspect for a size rejection")
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	t.Setenv("MIN_WIDTH", "800")
+	t.Setenv("MIN_HEIGHT", "")
+	t.Setenv("MAX_ASPECT", "2.5")
+	got, err := loadRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (acceptRules{minWidth: 800, maxAspect: 2.5}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	for _, bad := range []string{"0.5", "wide", "-2"} {
+		t.Setenv("MAX_ASPECT", bad)
+		if _, err := loadRules(); err == nil {
+			t.Errorf("MAX_ASPECT=%q accepted", bad)
+		}
+	}
+}
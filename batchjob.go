@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// S3 Batch Operations result codes. A temporary failure is retried by the
+// job; a permanent one is reported in the completion report.
+const (
+	batchSucceeded        = "Succeeded"
+	batchTemporaryFailure = "TemporaryFailure"
+	batchPermanentFailure = "PermanentFailure"
+)
+
+// BatchJobEvent is an S3 Batch Operations invocation. It covers both schema
+// versions: 1.0 names each task's bucket by ARN and 2.0 by name.
+type BatchJobEvent struct {
+	InvocationSchemaVersion string              `json:"invocationSchemaVersion"`
+	InvocationID            string              `json:"invocationId"`
+	Job                     events.S3BatchJobV2 `json:"job"`
+	Tasks                   []BatchJobTask      `json:"tasks"`
+}
+
+// BatchJobTask is one object of a batch job. The key is URL-encoded.
+type BatchJobTask struct {
+	TaskID      string `json:"taskId"`
+	S3Key       string `json:"s3Key"`
+	S3VersionID string `json:"s3VersionId"`
+	S3BucketARN string `json:"s3BucketArn"` // schema 1.0
+	S3Bucket    string `json:"s3Bucket"`    // schema 2.0
+}
+
+func (t BatchJobTask) bucket() string {
+	if t.S3Bucket != "" {
+		return t.S3Bucket
+	}
+	return strings.TrimPrefix(t.S3BucketARN, "arn:aws:s3:::")
+}
+
+// BatchJobHandler processes an S3 Batch Operations invocation, for backfills
+// of existing photos. Each task gets its own result code.
+func BatchJobHandler(ctx context.Context, event BatchJobEvent) (events.S3BatchJobResponse, error) {
+	cfg, client, err := setup(ctx)
+	if err != nil {
+		// Failing the invocation makes the job record every task as failed,
+		// which is right: no task can succeed with this configuration.
+		return events.S3BatchJobResponse{}, err
+	}
+	return handleBatchJob(ctx, client, cfg, event), nil
+}
+
+func handleBatchJob(ctx context.Context, client s3API, cfg settings, event BatchJobEvent) events.S3BatchJobResponse {
+	resp := events.S3BatchJobResponse{
+		InvocationSchemaVersion: event.InvocationSchemaVersion,
+		InvocationID:            event.InvocationID,
+		TreatMissingKeysAs:      batchPermanentFailure,
+	}
+	for _, task := range event.Tasks {
+		code, msg := runBatchTask(ctx, client, cfg, task)
+		resp.Results = append(resp.Results, events.S3BatchJobResult{
+			TaskID: task.TaskID, ResultCode: code, ResultString: msg,
+		})
+	}
+	return resp
+}
+
+// runBatchTask processes one task and classifies the outcome. The source is
+// looked up first, like a reprocess request, so the manifest records its ETag
+// and a missing object is reported before any download.
+func runBatchTask(ctx context.Context, client s3API, cfg settings, task BatchJobTask) (code, msg string) {
+	key, err := url.QueryUnescape(task.S3Key)
+	if err != nil {
+		return batchPermanentFailure, fmt.Sprintf("decoding object key %q: %v", task.S3Key, err)
+	}
+	rec, err := headSource(ctx, client, task.bucket(), key, task.S3VersionID)
+	if err != nil {
+		result, err := failedRecord(objectRecord{Bucket: task.bucket(), Key: key}, err)
+		return batchFailure(err), result.Error
+	}
+	result, err := attemptRecord(ctx, client, cfg, rec)
+	if err != nil {
+		return batchFailure(err), result.Error
+	}
+	return batchSucceeded, string(result.Status)
+}
+
+func batchFailure(err error) string {
+	if temporaryError(err) {
+		return batchTemporaryFailure
+	}
+	return batchPermanentFailure
+}
+
+// throttleCodes are the S3 error codes that mean "try again later".
+var throttleCodes = map[string]bool{
+	"SlowDown": true, "Throttling": true, "ThrottlingException": true,
+	"RequestLimitExceeded": true, "TooManyRequestsException": true,
+	"RequestTimeout": true, "InternalError": true, "ServiceUnavailable": true,
+}
+
+// temporaryError reports whether retrying err could succeed: S3 throttling
+// and server errors, network timeouts and running out of time. Everything
+// else, notably a file that does not decode or a key that does not exist,
+// fails the same way every time. The SDK has already retried throttling a
+// few times by the point it surfaces here.
+func temporaryError(err error) bool {
+	if errors.Is(err, ErrDeadline) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	var apiErr interface{ ErrorCode() string }
+	if errors.As(err, &apiErr) && throttleCodes[apiErr.ErrorCode()] {
+		return true
+	}
+	var httpErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &httpErr) {
+		if s := httpErr.HTTPStatusCode(); s == 429 || s >= 500 {
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// apiError stands in for the SDK's smithy and HTTP response errors, which
+// expose these methods.
+type apiError struct {
+	code   string
+	status int
+}
+
+func (e apiError) Error() string       { return fmt.Sprintf("api error %s (%d)", e.code, e.status) }
+func (e apiError) ErrorCode() string   { return e.code }
+func (e apiError) HTTPStatusCode() int { return e.status }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTemporaryError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"slow down", fmt.Errorf("getting s3://a/b: %w", apiError{"SlowDown", 503}), true},
+		{"throttled by code", apiError{"Throttling", 400}, true},
+		{"server error", apiError{"Whatever", 500}, true},
+		{"too many requests", apiError{"", 429}, true},
+		{"deadline", fmt.Errorf("x: %w", context.DeadlineExceeded), true},
+		{"network timeout", fmt.Errorf("x: %w", timeoutError{}), true},
+		{"access denied", apiError{"AccessDenied", 403}, false},
+		{"no such key", fmt.Errorf("x: %w", &types.NoSuchKey{}), false},
+		{"too large", fmt.Errorf("decoding a/b: %w", ErrTooLarge), false},
+		{"corrupt", errors.New("decoding a/b: image: unknown format"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := temporaryError(tc.err); got != tc.want {
+				t.Errorf("temporaryError(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestHandleBatchJob: every task gets its own result code, with corrupt and
+// missing objects permanent and throttling temporary.
+func TestHandleBatchJob(t *testing.T) {
+	fake := &fakeS3{
+		objects: map[string][]byte{
+			"tags/my bread/orig.png": testPNG(t, 800, 600),
+			"tags/tiny/orig.png":     testPNG(t, 200, 150),
+			"tags/soup/orig.jpg":     []byte("garbage"),
+			"tags/busy/orig.png":     testPNG(t, 800, 600),
+		},
+		getErrs: map[string]error{"tags/busy/orig.png": apiError{"SlowDown", 503}},
+	}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64, rules: acceptRules{minWidth: 400}}
+
+	var event BatchJobEvent
+	if err := json.Unmarshal([]byte(`{"invocationSchemaVersion":"1.0","invocationId":"inv","job":{"id":"job"},"tasks":[
+		{"taskId":"good","s3Key":"tags/my+bread/orig.png","s3BucketArn":"arn:aws:s3:::src"},
+		{"taskId":"tiny","s3Key":"tags/tiny/orig.png","s3BucketArn":"arn:aws:s3:::src"},
+		{"taskId":"corrupt","s3Key":"tags/soup/orig.jpg","s3BucketArn":"arn:aws:s3:::src"},
+		{"taskId":"missing","s3Key":"tags/pie/orig.png","s3BucketArn":"arn:aws:s3:::src"},
+		{"taskId":"throttled","s3Key":"tags/busy/orig.png","s3Bucket":"src"},
+		{"taskId":"badkey","s3Key":"tags/%zz.png","s3Bucket":"src"}]}`), &event); err != nil {
+		t.Fatal(err)
+	}
+	resp := handleBatchJob(context.Background(), fake, cfg, event)
+
+	if resp.InvocationID != "inv" || resp.InvocationSchemaVersion != "1.0" {
+		t.Errorf("response header = %+v", resp)
+	}
+	got := map[string]string{}
+	for _, r := range resp.Results {
+		got[r.TaskID] = r.ResultCode
+		if r.ResultString == "" {
+			t.Errorf("task %s has no result string", r.TaskID)
+		}
+	}
+	want := map[string]string{
+		"good":      batchSucceeded,
+		"tiny":      batchSucceeded, // rejected: a verdict, not a failure
+		"corrupt":   batchPermanentFailure,
+		"missing":   batchPermanentFailure,
+		"throttled": batchTemporaryFailure,
+		"badkey":    batchPermanentFailure,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("result codes = %v, want %v", got, want)
+	}
+	if fake.bodies["tags/my bread/manifest.json"] == nil {
+		t.Error("the good task's set was not uploaded")
+	}
+}
+
+// TestBatchJobVersion: a task naming a version fetches that version, not
+// whatever the key holds now, and the manifest records it.
+func TestBatchJobVersion(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{"tags/bread/orig.png": testPNG(t, 800, 600)}}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64}
+	task := BatchJobTask{TaskID: "t", S3Key: "tags/bread/orig.png", S3VersionID: "v1", S3Bucket: "src"}
+	if code, msg := runBatchTask(context.Background(), fake, cfg, task); code != batchSucceeded {
+		t.Fatalf("runBatchTask = %s, %s", code, msg)
+	}
+	if want := []string{"head v1", "get v1"}; !reflect.DeepEqual(fake.versions, want) {
+		t.Errorf("requested versions %v, want %v", fake.versions, want)
+	}
+	if got := fake.puts[len(fake.puts)-1]; got.Metadata[sourceVersionMetadata] != "v1" {
+		t.Errorf("%s records version %q, want v1", *got.Key, got.Metadata[sourceVersionMetadata])
+	}
+}
+
+func TestBatchJobTaskBucket(t *testing.T) {
+	for _, task := range []BatchJobTask{
+		{S3BucketARN: "arn:aws:s3:::src"},
+		{S3Bucket: "src"},
+	} {
+		if got := task.bucket(); got != "src" {
+			t.Errorf("%+v: bucket() = %q, want src", task, got)
+		}
+	}
+}
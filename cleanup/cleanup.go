@@ -26,7 +26,10 @@ func getDestinationPrefix(s3ObjectKey string) (string, error) {
 	// e.g. media/images/tags/bread/1200.webp
 	//      media/images/tags/bread/1200.jpeg
 	//      media/images/tags/bread/920.webp etc.
-	// we want to delete all media/images/tags/bread/* in the destination bucket
+	// This returns the source folder, the template's {prefix}. The folder
+	// actually cleaned is keyTemplate.setDir of it: the same folder by
+	// default, media/images/tags/bread/orig/ with PER_FILE_OUTPUT=true, and
+	// only the files the template produces for this source are deleted.
 	if s3ObjectKey == "" {
 		return "", errors.New("empty S3 object key")
 	}
@@ -43,6 +46,12 @@ func getDestinationPrefix(s3ObjectKey string) (string, error) {
 	return s3ObjectKey[:lastSlash], nil
 }
 
+// maxDeleteBatch is the most keys one DeleteObjects call accepts.
+const maxDeleteBatch = 1000
+
+// Handler deletes the destination files generated from a deleted source
+// object. Which files those are comes from KEY_TEMPLATE, which must match the
+// optimizer's.
 func Handler(ctx context.Context, event events.S3Event) (string, error) {
 	cfg, err := config.LoadDefaultConfig(context.TODO())
 	if err != nil {
@@ -73,61 +82,81 @@ func Handler(ctx context.Context, event events.S3Event) (string, error) {
 	if err != nil {
 		return "Error", err
 	}
-	listParams := s3.ListObjectsV2Input{
-		Bucket:  aws.String(destinationBucket),
-		Prefix:  aws.String(prefix),
-		MaxKeys: int32(maxKeys),
-	}
-	var toDelete []types.ObjectIdentifier
-
-	listOutput, err := client.ListObjectsV2(context.TODO(), &listParams)
-
+	keys, err := loadKeyTemplate()
 	if err != nil {
 		return "Error", err
 	}
-
-	for _, object := range listOutput.Contents {
-		toDelete = append(toDelete, types.ObjectIdentifier{Key: aws.String(*object.Key)})
+	stem := sourceStem(sourceObject)
+	dir := keys.setDir(prefix, stem)
+	if dir == "" {
+		// Same reasoning as getDestinationPrefix: the listing below would
+		// cover the whole bucket.
+		return "Error", fmt.Errorf("refusing to clean up %q: KEY_TEMPLATE %q puts its files at the bucket root", sourceObject, keys.raw)
 	}
 
-	if len(toDelete) == 0 {
-		fmt.Printf("Nothing to delete under %s/%s\n", destinationBucket, prefix)
-		return "Success", nil
+	// The directory can hold more than this photo's files (a {sourceStem}
+	// folder nested in another's, or anything else written there), so list
+	// all of it and keep only this photo's files.
+	listParams := s3.ListObjectsV2Input{
+		Bucket:  aws.String(destinationBucket),
+		Prefix:  aws.String(dir + "/"),
+		MaxKeys: int32(maxKeys),
 	}
-
-	deleteParams := s3.DeleteObjectsInput{
-		Bucket: aws.String(destinationBucket),
-		Delete: &types.Delete{Objects: toDelete},
+	var listed []string
+	for {
+		listOutput, err := client.ListObjectsV2(ctx, &listParams)
+		if err != nil {
+			return "Error", err
+		}
+		for _, object := range listOutput.Contents {
+			listed = append(listed, aws.ToString(object.Key))
+		}
+		if !listOutput.IsTruncated {
+			break
+		}
+		listParams.ContinuationToken = listOutput.NextContinuationToken
 	}
-	res, err := client.DeleteObjects(ctx, &deleteParams)
-	if err != nil {
-		return "Error", fmt.Errorf("deleting %d objects under %s/%s: %w",
-			len(toDelete), destinationBucket, prefix, err)
+
+	owned := keys.deleteSet(listed, prefix, stem)
+	if len(owned) == 0 {
+		fmt.Printf("Nothing to delete for %s under %s/%s\n", sourceObject, destinationBucket, dir)
+		return "Success", nil
 	}
 
-	// DeleteObjects reports per-object failures in res.Errors rather than
-	// returning an error, so without this check a partial failure is
-	// indistinguishable from a clean run.
-	if len(res.Errors) > 0 {
+	deleted, failed := 0, 0
+	for start := 0; start < len(owned); start += maxDeleteBatch {
+		end := start + maxDeleteBatch
+		if end > len(owned) {
+			end = len(owned)
+		}
+		var toDelete []types.ObjectIdentifier
+		for _, k := range owned[start:end] {
+			toDelete = append(toDelete, types.ObjectIdentifier{Key: aws.String(k)})
+		}
+		res, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(destinationBucket),
+			Delete: &types.Delete{Objects: toDelete},
+		})
+		if err != nil {
+			return "Error", fmt.Errorf("deleting %d objects under %s/%s: %w",
+				len(toDelete), destinationBucket, dir, err)
+		}
+		// DeleteObjects reports per-object failures in res.Errors rather than
+		// returning an error, so without this check a partial failure is
+		// indistinguishable from a clean run.
 		for _, e := range res.Errors {
 			fmt.Printf("Failed to delete %s: %s %s\n",
 				aws.ToString(e.Key), aws.ToString(e.Code), aws.ToString(e.Message))
 		}
-		return "Error", fmt.Errorf("deleted %d of %d objects under %s/%s, %d failed",
-			len(res.Deleted), len(toDelete), destinationBucket, prefix, len(res.Errors))
+		deleted += len(res.Deleted)
+		failed += len(res.Errors)
 	}
-
-	fmt.Printf("Deleted %d objects under %s/%s\n", len(res.Deleted), destinationBucket, prefix)
-
-	// This function reads a single ListObjectsV2 page and does not paginate,
-	// so a truncated listing means the folder is only partly cleaned. Test
-	// IsTruncated rather than comparing counts: the standard derivative set is
-	// exactly MAX_KEYS objects, so a count comparison warns on every clean run.
-	if listOutput.IsTruncated {
-		fmt.Printf("WARNING: more than MAX_KEYS (%d) objects under %s/%s; some were not deleted\n",
-			maxKeys, destinationBucket, prefix)
+	if failed > 0 {
+		return "Error", fmt.Errorf("deleted %d of %d objects under %s/%s, %d failed",
+			deleted, len(owned), destinationBucket, dir, failed)
 	}
 
+	fmt.Printf("Deleted %d objects under %s/%s\n", deleted, destinationBucket, dir)
 	return "Success", nil
 }
 
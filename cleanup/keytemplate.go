@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This is the optimizer's KEY_TEMPLATE, repeated here because the cleaner is a
+// separate module. Both functions must be given the same value: the
+// optimizer decides where files go, and this decides which files a deleted
+// original owns. Keep the two in step.
+const (
+	defaultKeyTemplate = "{prefix}/{name}.{ext}"
+	hashedKeyTemplate  = "{prefix}/{name}.{hash}.{ext}"
+
+	perFileKeyTemplate       = "{prefix}/{sourceStem}/{name}.{ext}"
+	perFileHashedKeyTemplate = "{prefix}/{sourceStem}/{name}.{hash}.{ext}"
+)
+
+// keyPlaceholders maps each placeholder to whether it varies per file.
+var keyPlaceholders = map[string]bool{
+	"prefix": false, "sourceStem": false,
+	"name": true, "width": true, "height": true, "format": true, "ext": true, "hash": true,
+}
+
+// setFiles are the fixed-name files the optimizer writes to a set directory.
+var setFiles = []string{"meta.json", "manifest.json", "picture.html", "rejected.json"}
+
+type keyTemplate struct {
+	raw   string
+	parts []keyPart
+}
+
+type keyPart struct {
+	literal     string
+	placeholder string
+}
+
+// parseKeyTemplate applies the optimizer's validation, so a template one
+// accepts the other does too.
+func parseKeyTemplate(raw string) (keyTemplate, error) {
+	t := keyTemplate{raw: raw}
+	if strings.TrimSpace(raw) == "" {
+		return t, errors.New("empty key template")
+	}
+	seen := map[string]bool{}
+	rest := raw
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.parts = append(t.parts, keyPart{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return t, fmt.Errorf("key template %q: unmatched }", raw)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, keyPart{literal: rest[:open]})
+		}
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return t, fmt.Errorf("key template %q: unclosed {", raw)
+		}
+		name := rest[open+1 : open+1+end]
+		if _, ok := keyPlaceholders[name]; !ok {
+			return t, fmt.Errorf("key template %q: unknown placeholder {%s}", raw, name)
+		}
+		seen[name] = true
+		t.parts = append(t.parts, keyPart{placeholder: name})
+		rest = rest[open+2+end:]
+	}
+
+	switch {
+	case !seen["name"]:
+		return t, fmt.Errorf("key template %q: must contain {name}", raw)
+	case !seen["ext"] && !seen["format"]:
+		return t, fmt.Errorf("key template %q: must contain {ext} or {format}", raw)
+	case strings.HasPrefix(raw, "/") || strings.HasSuffix(raw, "/"):
+		return t, fmt.Errorf("key template %q: must not start or end with /", raw)
+	}
+	for _, seg := range strings.Split(raw, "/") {
+		if seg == "." || seg == ".." {
+			return t, fmt.Errorf("key template %q: %q segments are not allowed", raw, seg)
+		}
+	}
+	if !t.stemBounded() {
+		return t, fmt.Errorf("key template %q: {sourceStem} must have a / or . on each side, or the cleanup "+
+			"function could take one photo's files for another's whose name starts the same", raw)
+	}
+	// The set's fixed-name files are shared by every source whose set
+	// folder is the same, so deleting one source would delete them all.
+	if seen["sourceStem"] && !strings.Contains(t.setDirTemplate(), "{sourceStem}") {
+		return t, fmt.Errorf("key template %q: {sourceStem} must be part of the set's folder, or every photo "+
+			"in a folder shares one manifest.json; use a folder per source such as {prefix}/{sourceStem}/", raw)
+	}
+	return t, nil
+}
+
+// stemBounded reports whether every {sourceStem} is delimited by / or ., or
+// the start or end of the template. A stem never contains /, and names never
+// contain . or /, so that is what keeps stem "a" from matching the keys of
+// "a-b" or "a.b".
+func (t keyTemplate) stemBounded() bool {
+	for i, p := range t.parts {
+		if p.placeholder != "sourceStem" {
+			continue
+		}
+		if i > 0 && !strings.HasSuffix(t.parts[i-1].literal, "/") && !strings.HasSuffix(t.parts[i-1].literal, ".") {
+			return false
+		}
+		if i < len(t.parts)-1 && !strings.HasPrefix(t.parts[i+1].literal, "/") && !strings.HasPrefix(t.parts[i+1].literal, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// loadKeyTemplate reads KEY_TEMPLATE, HASHED_KEYS and PER_FILE_OUTPUT
+// exactly as the optimizer does.
+func loadKeyTemplate() (keyTemplate, error) {
+	hashed, err := envBool("HASHED_KEYS")
+	if err != nil {
+		return keyTemplate{}, err
+	}
+	perFile, err := envBool("PER_FILE_OUTPUT")
+	if err != nil {
+		return keyTemplate{}, err
+	}
+	raw := os.Getenv("KEY_TEMPLATE")
+	switch {
+	case raw != "" && hashed:
+		return keyTemplate{}, errors.New("KEY_TEMPLATE and HASHED_KEYS are both set; put {hash} in KEY_TEMPLATE instead")
+	case raw != "" && perFile:
+		return keyTemplate{}, errors.New("KEY_TEMPLATE and PER_FILE_OUTPUT are both set; put {sourceStem} in KEY_TEMPLATE instead")
+	case perFile && hashed:
+		raw = perFileHashedKeyTemplate
+	case perFile:
+		raw = perFileKeyTemplate
+	case hashed:
+		raw = hashedKeyTemplate
+	case raw == "":
+		raw = defaultKeyTemplate
+	}
+	t, err := parseKeyTemplate(raw)
+	if err != nil {
+		return t, fmt.Errorf("KEY_TEMPLATE: %w", err)
+	}
+	return t, nil
+}
+
+func envBool(name string) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid value %q", name, v)
+	}
+	return b, nil
+}
+
+// setDir is the directory holding a set's fixed-name files, and the
+// directory every key of the set lives under: the template up to the last
+// slash before the first per-file placeholder.
+func (t keyTemplate) setDir(prefix, stem string) string {
+	return cleanKey(strings.NewReplacer("{prefix}", prefix, "{sourceStem}", stem).Replace(t.setDirTemplate()))
+}
+
+// setDirTemplate is setDir before the placeholders are filled in.
+func (t keyTemplate) setDirTemplate() string {
+	var fixed strings.Builder
+	for _, p := range t.parts {
+		if keyPlaceholders[p.placeholder] {
+			break
+		}
+		if p.placeholder != "" {
+			fixed.WriteString("{" + p.placeholder + "}")
+		} else {
+			fixed.WriteString(p.literal)
+		}
+	}
+	dir := fixed.String()
+	if i := strings.LastIndex(dir, "/"); i >= 0 {
+		return dir[:i]
+	}
+	return ""
+}
+
+// matcher matches the keys the template produces for one source. The
+// source's own placeholders are fixed; the per-file ones match what the
+// optimizer can put there, none of which contains a dot, so a stem followed
+// by a dot cannot run into another stem that starts the same.
+func (t keyTemplate) matcher(prefix, stem string) *regexp.Regexp {
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch p.placeholder {
+		case "":
+			b.WriteString(p.literal)
+		case "prefix":
+			b.WriteString(prefix)
+		case "sourceStem":
+			b.WriteString(stem)
+		default:
+			b.WriteString("\x00" + p.placeholder + "\x00")
+		}
+	}
+	// Clean the rendered key as the optimizer does, then quote it and swap
+	// the markers for patterns.
+	pattern := regexp.QuoteMeta(cleanKey(b.String()))
+	pattern = strings.NewReplacer(
+		"\x00name\x00", `[^/.]+`,
+		"\x00width\x00", `[0-9]+`,
+		"\x00height\x00", `[0-9]+`,
+		"\x00format\x00", `(?:jpeg|webp|png)`,
+		"\x00ext\x00", `(?:jpeg|webp|png)`,
+		"\x00hash\x00", `[0-9a-f]+`,
+	).Replace(pattern)
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+// deleteSet picks, from keys listed under the set directory, the ones that
+// belong to the source: the images the template produces for it, and the
+// set's fixed-name files. Anything else under the same directory - another
+// photo's files when several share a folder - is left alone.
+func (t keyTemplate) deleteSet(keys []string, prefix, stem string) []string {
+	dir := t.setDir(prefix, stem)
+	fixed := map[string]bool{}
+	for _, f := range setFiles {
+		fixed[objectKey(dir, f)] = true
+	}
+	m := t.matcher(prefix, stem)
+	var out []string
+	for _, k := range keys {
+		if fixed[k] || m.MatchString(k) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// cleanKey drops empty path segments.
+func cleanKey(key string) string {
+	segs := strings.Split(key, "/")
+	kept := segs[:0]
+	for _, s := range segs {
+		if s != "" {
+			kept = append(kept, s)
+		}
+	}
+	return strings.Join(kept, "/")
+}
+
+func objectKey(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// sourceStem is a source key's file name without its extension.
+func sourceStem(key string) string {
+	name := path.Base(key)
+	return strings.TrimSuffix(name, path.Ext(name))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func mustKeyTemplate(t *testing.T, raw string) keyTemplate {
+	t.Helper()
+	k, err := parseKeyTemplate(raw)
+	if err != nil {
+		t.Fatalf("parseKeyTemplate(%q): %v", raw, err)
+	}
+	return k
+}
+
+func TestParseKeyTemplate(t *testing.T) {
+	tests := []struct {
+		raw     string
+		wantErr bool
+	}{
+		{defaultKeyTemplate, false},
+		{hashedKeyTemplate, false},
+		{"{prefix}/{format}/{name}.{ext}", false},
+		{"renditions/{sourceStem}/{name}@{width}w.{ext}", false},
+		{"", true},
+		{"{prefix}/orig.{ext}", true},
+		{"{prefix}/{name}", true},
+		{"{prefix}/{name}.{bogus}", true},
+		{"{prefix}/{name.{ext}", true},
+		{"{prefix}/name}.{ext}", true},
+		{"/{name}.{ext}", true},
+		{"{prefix}/../{name}.{ext}", true},
+		{"{prefix}/{sourceStem}.{name}.{ext}", true}, // one manifest.json for the whole folder
+		{"{prefix}/{sourceStem}.set/{name}.{ext}", false},
+		{"{prefix}/{sourceStem}-{name}.{ext}", true},
+		{"{prefix}/{name}-{sourceStem}.{ext}", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.raw, func(t *testing.T) {
+			_, err := parseKeyTemplate(tc.raw)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("parseKeyTemplate(%q) error = %v, wantErr %v", tc.raw, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadKeyTemplate(t *testing.T) {
+	tests := []struct {
+		name, template, hashed, perFile string
+		want                            string
+		wantErr                         bool
+	}{
+		{"default", "", "", "", defaultKeyTemplate, false},
+		{"hashed", "", "true", "", hashedKeyTemplate, false},
+		{"per file", "", "", "true", perFileKeyTemplate, false},
+		{"per file hashed", "", "true", "true", perFileHashedKeyTemplate, false},
+		{"template", "{prefix}/{format}/{name}.{ext}", "", "", "{prefix}/{format}/{name}.{ext}", false},
+		{"both", "{prefix}/{name}.{ext}", "true", "", "", true},
+		{"template and per file", "{prefix}/{name}.{ext}", "", "true", "", true},
+		{"bad bool", "", "yes please", "", "", true},
+		{"bad per file", "", "", "yes please", "", true},
+		{"bad template", "{prefix}/orig.jpeg", "", "", "", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("KEY_TEMPLATE", tc.template)
+			t.Setenv("HASHED_KEYS", tc.hashed)
+			t.Setenv("PER_FILE_OUTPUT", tc.perFile)
+			got, err := loadKeyTemplate()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("loadKeyTemplate() = %q, want error", got.raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.raw != tc.want {
+				t.Errorf("got %q, want %q", got.raw, tc.want)
+			}
+		})
+	}
+}
+
+func TestKeyTemplateSetDir(t *testing.T) {
+	tests := []struct {
+		template, prefix, stem string
+		want                   string
+	}{
+		{defaultKeyTemplate, "media/images/tags/bread", "orig", "media/images/tags/bread"},
+		{"{prefix}/{format}/{name}.{ext}", "a/b", "x", "a/b"},
+		{"renditions/{sourceStem}/{name}@{width}w.{ext}", "a/b", "IMG_0042", "renditions/IMG_0042"},
+		{"{prefix}/{sourceStem}.set/{name}.{ext}", "a/b", "IMG_0042", "a/b/IMG_0042.set"},
+		{perFileKeyTemplate, "tags/bread", "IMG_0042", "tags/bread/IMG_0042"},
+		{"{sourceStem}/{name}.{ext}", "a/b", "IMG_0042", "IMG_0042"},
+		// Nothing fixed before the first per-file placeholder: the bucket
+		// root, which Handler refuses.
+		{"{format}/{prefix}/{name}.{ext}", "a/b", "IMG_0042", ""},
+		{defaultKeyTemplate, "", "orig", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.template, func(t *testing.T) {
+			if got := mustKeyTemplate(t, tc.template).setDir(tc.prefix, tc.stem); got != tc.want {
+				t.Errorf("setDir(%q, %q) = %q, want %q", tc.prefix, tc.stem, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestDeleteSet checks that a deleted photo takes its own files with it and
+// leaves its neighbours' alone.
+func TestDeleteSet(t *testing.T) {
+	tests := []struct {
+		name, template, prefix, stem string
+		listed                       []string
+		want                         []string
+	}{
+		{
+			name:     "default layout owns its folder",
+			template: defaultKeyTemplate,
+			prefix:   "tags/bread",
+			stem:     "orig",
+			listed: []string{
+				"tags/bread/orig.jpeg", "tags/bread/1200.webp", "tags/bread/thumbnail.jpeg",
+				"tags/bread/meta.json", "tags/bread/manifest.json", "tags/bread/picture.html",
+				"tags/bread/notes.txt", "tags/bread/sub/1200.webp",
+			},
+			want: []string{
+				"tags/bread/orig.jpeg", "tags/bread/1200.webp", "tags/bread/thumbnail.jpeg",
+				"tags/bread/meta.json", "tags/bread/manifest.json", "tags/bread/picture.html",
+			},
+		},
+		{
+			name:     "hashed",
+			template: hashedKeyTemplate,
+			prefix:   "tags/bread",
+			stem:     "orig",
+			listed:   []string{"tags/bread/1200.2d7116.webp", "tags/bread/1200.webp", "tags/bread/1200.XYZ.webp", "tags/bread/rejected.json"},
+			want:     []string{"tags/bread/1200.2d7116.webp", "tags/bread/rejected.json"},
+		},
+		{
+			name:     "per file output leaves the sibling set",
+			template: perFileKeyTemplate,
+			prefix:   "tags/bread",
+			stem:     "IMG_1",
+			listed: []string{
+				"tags/bread/IMG_1/orig.jpeg", "tags/bread/IMG_1/1200.webp", "tags/bread/IMG_1/manifest.json",
+				"tags/bread/IMG_10/orig.jpeg",
+			},
+			want: []string{"tags/bread/IMG_1/orig.jpeg", "tags/bread/IMG_1/1200.webp", "tags/bread/IMG_1/manifest.json"},
+		},
+		{
+			name:     "format folders",
+			template: "{prefix}/{format}/{name}.{ext}",
+			prefix:   "a",
+			stem:     "orig",
+			listed:   []string{"a/webp/1200.webp", "a/jpeg/thumbnail.jpeg", "a/gif/1200.gif", "a/meta.json"},
+			want:     []string{"a/webp/1200.webp", "a/jpeg/thumbnail.jpeg", "a/meta.json"},
+		},
+		{
+			name:     "photos sharing a source folder keep their fixed files",
+			template: "{prefix}/{sourceStem}.set/{name}.{ext}",
+			prefix:   "gallery",
+			stem:     "a",
+			listed: []string{
+				"gallery/a.set/1200.webp", "gallery/a.set/manifest.json",
+				"gallery/a.b.set/1200.webp", "gallery/a.b.set/manifest.json",
+			},
+			want: []string{"gallery/a.set/1200.webp", "gallery/a.set/manifest.json"},
+		},
+		{
+			name:     "a stem that starts another's",
+			template: perFileHashedKeyTemplate,
+			prefix:   "gallery",
+			stem:     "a",
+			listed: []string{
+				"gallery/a/1200.2d7116.webp", "gallery/a/meta.json",
+				"gallery/a.b/1200.2d7116.webp", "gallery/a-b/meta.json",
+			},
+			want: []string{"gallery/a/1200.2d7116.webp", "gallery/a/meta.json"},
+		},
+		{
+			name:     "regexp metacharacters in the source name are literal",
+			template: "renditions/{sourceStem}/{name}.{ext}",
+			prefix:   "x",
+			stem:     "a.b+c",
+			listed:   []string{"renditions/a.b+c/1200.webp", "renditions/aXb+c/1200.webp"},
+			want:     []string{"renditions/a.b+c/1200.webp"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mustKeyTemplate(t, tc.template).deleteSet(tc.listed, tc.prefix, tc.stem)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("deleteSet() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
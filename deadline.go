@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrDeadline marks a run abandoned because the invocation was about to time
+// out. The new set has not been published when it is returned: its
+// orig.jpeg and manifest.json are the last files written. Some of its sizes
+// may have overwritten the previous set's under plain file names.
+var ErrDeadline = errors.New("deadline approaching")
+
+// uploadReserve is the time kept back for uploading a set once it has been
+// generated. A run that would start a stage with less left than this stops
+// instead, since the set could not be published anyway. Tests shorten it.
+var uploadReserve = 5 * time.Second
+
+// shutdownMargin is how long before the deadline uploads are cancelled, so
+// the failure is logged and returned rather than cut off by the platform
+// killing the process.
+const shutdownMargin = 500 * time.Millisecond
+
+// checkDeadline returns an ErrDeadline when ctx is done or has less than
+// reserve left. A context without a deadline, as on the command line, only
+// fails once cancelled.
+func checkDeadline(ctx context.Context, reserve time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrDeadline, err)
+	}
+	if d, ok := ctx.Deadline(); ok {
+		if left := time.Until(d); left < reserve {
+			return fmt.Errorf("%w: %v left, %v needed", ErrDeadline, left.Round(time.Millisecond), reserve)
+		}
+	}
+	return nil
+}
+
+// uploadContext ends shutdownMargin before ctx's deadline, if it has one.
+func uploadContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, d.Add(-shutdownMargin))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestCheckDeadline(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	soon, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	later, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		want bool // ErrDeadline
+	}{
+		{"no deadline", context.Background(), false},
+		{"plenty left", later, false},
+		{"less than the reserve", soon, true},
+		{"cancelled", cancelled, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := checkDeadline(tc.ctx, 5*time.Second); errors.Is(err, ErrDeadline) != tc.want {
+				t.Errorf("checkDeadline() = %v, want ErrDeadline %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestProcessImageStopsAtDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), uploadReserve/2)
+	defer cancel()
+	_, _, err := processImage(ctx, synthImage(800, 600), getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
+	if !errors.Is(err, ErrDeadline) {
+		t.Errorf("processImage() = %v, want ErrDeadline", err)
+	}
+}
+
+// TestHandleRecordDeadlinePublishesNothing: a record with too little time
+// left stops before uploading a single file, and is worth retrying.
+func TestHandleRecordDeadlinePublishesNothing(t *testing.T) {
+	fake := &fakeS3{object: testPNG(t, 800, 600)}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64}
+	ctx, cancel := context.WithTimeout(context.Background(), uploadReserve/2)
+	defer cancel()
+	err := handleRecord(ctx, fake, cfg, objectRecord{Bucket: "src", Key: "tags/bread/orig.png"})
+	if !errors.Is(err, ErrDeadline) || !temporaryError(err) {
+		t.Errorf("handleRecord() = %v, want a temporary ErrDeadline", err)
+	}
+	if len(fake.puts) != 0 {
+		t.Errorf("%d files uploaded", len(fake.puts))
+	}
+}
+
+// slowPuts takes putDelay over every upload, or until the context ends.
+type slowPuts struct {
+	*fakeS3
+	putDelay time.Duration
+}
+
+func (s slowPuts) PutObject(ctx context.Context, in *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	select {
+	case <-time.After(s.putDelay):
+		return s.fakeS3.PutObject(ctx, in, opts...)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TestUploadDerivativesStopsBeforeManifest: uploads running into the
+// deadline give up before it, and before orig.jpeg and the manifest.
+func TestUploadDerivativesStopsBeforeManifest(t *testing.T) {
+	defer func(r time.Duration) { uploadReserve = r }(uploadReserve)
+	uploadReserve = 50 * time.Millisecond
+
+	derivatives := []Derivative{
+		{Name: "orig", Format: FormatJPEG, Key: "a/orig.jpeg"},
+		{Name: "400", Format: FormatJPEG, Key: "a/400.jpeg"},
+		{Name: "400", Format: FormatWEBP, Key: "a/400.webp"},
+		{Name: manifestName, Format: FormatJSON, Key: "a/manifest.json"},
+	}
+	fake := &fakeS3{}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownMargin+300*time.Millisecond)
+	defer cancel()
+	err := uploadDerivatives(ctx, slowPuts{fake, 200 * time.Millisecond}, "dest", derivatives)
+	if !errors.Is(err, ErrDeadline) {
+		t.Fatalf("uploadDerivatives() = %v, want ErrDeadline", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("gave up only after the deadline")
+	}
+	for _, key := range []string{"a/orig.jpeg", "a/manifest.json"} {
+		if fake.bodies[key] != nil {
+			t.Errorf("%s was uploaded", key)
+		}
+	}
+}
+
+func TestUploadOrder(t *testing.T) {
+	got := uploadOrder([]Derivative{
+		{Name: "orig", Format: FormatJPEG}, {Name: manifestName, Format: FormatJSON},
+		{Name: "400", Format: FormatJPEG}, {Name: "meta", Format: FormatJSON}, {Name: "thumbnail", Format: FormatJPEG},
+	})
+	var names []string
+	for _, d := range got {
+		names = append(names, d.Name)
+	}
+	want := []string{"400", "meta", "thumbnail", "orig", manifestName}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("order = %v, want %v", names, want)
+		}
+	}
+}
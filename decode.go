@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
 
@@ -30,21 +31,168 @@ func init() {
 	image.RegisterFormat("heic", "????ftypmif1", heic.Decode, heic.DecodeConfig)
 }
 
-// maxPixels bounds the input we are willing to decode. libvips used to protect
-// us here implicitly via shrink-on-load; pure Go must decode at full
-// resolution, so a huge upload would otherwise blow up Lambda's memory.
-const maxPixels = 40_000_000
+// Decode limits. libvips used to protect us implicitly via shrink-on-load;
+// pure Go must decode at full resolution, so a huge upload would otherwise
+// blow up Lambda's memory. Each can be overridden from the environment (see
+// loadLimits); these are the values used when it is not.
+const (
+	defaultMaxPixels     = 40_000_000
+	defaultMaxInputBytes = 100 << 20
+	defaultMaxDimension  = 30_000
+)
+
+// ErrTooLarge and ErrTooManyFrames mark an input that was refused by a limit,
+// as opposed to one that failed to decode. Test with errors.Is.
+var (
+	ErrTooLarge      = errors.New("image too large")
+	ErrTooManyFrames = errors.New("animation has too many frames")
+)
+
+// decodeLimits bounds what decodeImage will accept. A zero field means the
+// default; memoryBytes of zero means the available memory is unknown (the
+// local CLI) and the memory estimate is skipped.
+type decodeLimits struct {
+	maxPixels     int
+	maxInputBytes int
+	maxDimension  int
+	memoryBytes   int
+}
+
+func (l decodeLimits) withDefaults() decodeLimits {
+	if l.maxPixels == 0 {
+		l.maxPixels = defaultMaxPixels
+	}
+	if l.maxInputBytes == 0 {
+		l.maxInputBytes = defaultMaxInputBytes
+	}
+	if l.maxDimension == 0 {
+		l.maxDimension = defaultMaxDimension
+	}
+	return l
+}
+
+// loadLimits reads MAX_PIXELS, MAX_INPUT_BYTES and MAX_DIMENSION, and takes the
+// memory budget from AWS_LAMBDA_FUNCTION_MEMORY_SIZE (in MB), which Lambda sets
+// and nothing else does.
+func loadLimits() (decodeLimits, error) {
+	var l decodeLimits
+	var err error
+	if l.maxPixels, err = envInt("MAX_PIXELS", defaultMaxPixels); err != nil {
+		return l, err
+	}
+	if l.maxInputBytes, err = envInt("MAX_INPUT_BYTES", defaultMaxInputBytes); err != nil {
+		return l, err
+	}
+	if l.maxDimension, err = envInt("MAX_DIMENSION", defaultMaxDimension); err != nil {
+		return l, err
+	}
+	mb, err := envInt("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", 0)
+	if err != nil {
+		return l, err
+	}
+	l.memoryBytes = mb << 20
+	return l, nil
+}
+
+// decodedBytesPerPixel is the worst case one decoded frame costs in each input
+// format, before we convert it to RGBA. The WASM-backed decoders build the
+// frame in their own linear memory and then copy it out, so they pay twice.
+var decodedBytesPerPixel = map[string]int{
+	"jpeg": 4, // YCbCr 4:4:4 or CMYK
+	"png":  8, // 16-bit RGBA64
+	"gif":  1, // paletted
+	"tiff": 8,
+	"webp": 8,
+	"heic": 8,
+}
+
+// workingBytesPerPixel covers our own full-size canvases: the RGBA copy made
+// by applyOrientation and the flattened base in processImage.
+const workingBytesPerPixel = 8
+
+// memoryHeadroom is the share of the function's memory an image may claim.
+// The rest is the Go runtime, the encoded derivatives and the pixel pool.
+const memoryHeadroom = 0.75
+
+// checkLimits applies every limit to an image that has not been decoded yet.
+func checkLimits(data []byte, cfg image.Config, format string, lim decodeLimits) error {
+	if cfg.Width > lim.maxDimension || cfg.Height > lim.maxDimension {
+		return fmt.Errorf("%w: %dx%d, longest side limit is %d",
+			ErrTooLarge, cfg.Width, cfg.Height, lim.maxDimension)
+	}
+	px := cfg.Width * cfg.Height
+	if px > lim.maxPixels {
+		return fmt.Errorf("%w: %dx%d = %d pixels, limit is %d",
+			ErrTooLarge, cfg.Width, cfg.Height, px, lim.maxPixels)
+	}
+	if lim.memoryBytes == 0 {
+		return nil
+	}
+
+	bpp, ok := decodedBytesPerPixel[format]
+	if !ok {
+		bpp = 8
+	}
+	frames := frameCount(data, format)
+	budget := int(float64(lim.memoryBytes) * memoryHeadroom)
+	if need := px * (bpp*frames + workingBytesPerPixel); need > budget {
+		if frames > 1 && px*(bpp+workingBytesPerPixel) <= budget {
+			return fmt.Errorf("%w: %d frames of %dx%d need ~%d MB, budget is %d MB",
+				ErrTooManyFrames, frames, cfg.Width, cfg.Height, need>>20, budget>>20)
+		}
+		return fmt.Errorf("%w: %dx%d %s needs ~%d MB to decode, budget is %d MB",
+			ErrTooLarge, cfg.Width, cfg.Height, format, need>>20, budget>>20)
+	}
+	return nil
+}
+
+// frameCount is how many frames the decoder will hold in memory at once.
+// image/gif stops after the first frame and the HEIC decoder only reads the
+// primary image, but gen2brain/webp decodes every frame of an animation even
+// when asked for one.
+func frameCount(data []byte, format string) int {
+	if format == "webp" {
+		return webpFrames(data)
+	}
+	return 1
+}
+
+// webpFrames counts the ANMF chunks in a RIFF/WEBP container, or returns 1
+// for a still image. Like jpegOrientation, every read is bounds-checked.
+func webpFrames(data []byte) int {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 1
+	}
+	frames := 0
+	for i := 12; i+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		if string(data[i:i+4]) == "ANMF" {
+			frames++
+		}
+		if size < 0 || size > len(data) {
+			break
+		}
+		i += 8 + size + size&1 // chunks are padded to an even length
+	}
+	return max(frames, 1)
+}
 
 // decodeImage decodes an uploaded image and applies its EXIF orientation.
 // It returns the oriented image and the name of the format that was detected.
-func decodeImage(data []byte) (image.Image, string, error) {
+// Only the header is read before the limits are checked, so a rejected image
+// never allocates its canvas.
+func decodeImage(data []byte, lim decodeLimits) (image.Image, string, error) {
+	lim = lim.withDefaults()
+	if len(data) > lim.maxInputBytes {
+		return nil, "", fmt.Errorf("%w: %d bytes, limit is %d", ErrTooLarge, len(data), lim.maxInputBytes)
+	}
+
 	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
 	if err != nil {
 		return nil, "", fmt.Errorf("unrecognised image format: %w", err)
 	}
-	if px := cfg.Width * cfg.Height; px > maxPixels {
-		return nil, format, fmt.Errorf("image too large: %dx%d = %d pixels, limit is %d",
-			cfg.Width, cfg.Height, px, maxPixels)
+	if err := checkLimits(data, cfg, format, lim); err != nil {
+		return nil, format, err
 	}
 
 	img, format, err := image.Decode(bytes.NewReader(data))
@@ -172,12 +320,13 @@ func applyOrientation(src image.Image, orientation int) image.Image {
 	if orientation >= 5 {
 		dstW, dstH = h, w
 	}
-	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	dst := newRGBA(image.Rect(0, 0, dstW, dstH))
 
 	// Work from an RGBA copy so the inner loop is a straight memory read.
 	srcRGBA, ok := src.(*image.RGBA)
 	if !ok || srcRGBA.Bounds() != b {
-		tmp := image.NewRGBA(image.Rect(0, 0, w, h))
+		tmp := newRGBA(image.Rect(0, 0, w, h))
+		defer releaseImage(tmp)
 		draw.Copy(tmp, image.Point{}, src, b, draw.Src, nil)
 		srcRGBA = tmp
 	}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"image"
 	"image/color"
+	"image/draw"
+	"image/png"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/gen2brain/webp"
 )
 
 // TestOrientation decodes each of the eight EXIF orientation variants and
@@ -20,7 +25,7 @@ func TestOrientation(t *testing.T) {
 		if err != nil {
 			t.Skipf("fixture %s missing: %v", refPath, err)
 		}
-		ref, _, err := decodeImage(refData)
+		ref, _, err := decodeImage(refData, decodeLimits{})
 		if err != nil {
 			t.Fatalf("%s: %v", refPath, err)
 		}
@@ -32,7 +37,7 @@ func TestOrientation(t *testing.T) {
 				if err != nil {
 					t.Skipf("fixture missing: %v", err)
 				}
-				got, _, err := decodeImage(data)
+				got, _, err := decodeImage(data, decodeLimits{})
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -126,7 +131,7 @@ func TestDecodeHEIC(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			img, format, err := decodeImage(data)
+			img, format, err := decodeImage(data, decodeLimits{})
 			if err != nil {
 				t.Fatalf("decodeImage: %v", err)
 			}
@@ -151,12 +156,93 @@ func TestDecodeRejectsGarbage(t *testing.T) {
 		{},
 		bytes.Repeat([]byte{0}, 1024),
 	} {
-		if _, _, err := decodeImage(data); err == nil {
+		if _, _, err := decodeImage(data, decodeLimits{}); err == nil {
 			t.Errorf("decodeImage(%d bytes of garbage) succeeded, want error", len(data))
 		}
 	}
 }
 
+// TestDecodeLimits: each limit must refuse with ErrTooLarge, so callers can
+// tell a rejection from a decode failure.
+func TestDecodeLimits(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 400, 100))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	tests := []struct {
+		name    string
+		lim     decodeLimits
+		wantErr error
+	}{
+		{"defaults accept", decodeLimits{}, nil},
+		{"max pixels", decodeLimits{maxPixels: 39_999}, ErrTooLarge},
+		{"max dimension", decodeLimits{maxDimension: 399}, ErrTooLarge},
+		{"max input bytes", decodeLimits{maxInputBytes: len(data) - 1}, ErrTooLarge},
+		// 40k px x (8 decoded + 8 working) = 640 kB, against 75% of the budget.
+		{"memory budget", decodeLimits{memoryBytes: 800_000}, ErrTooLarge},
+		{"memory budget fits", decodeLimits{memoryBytes: 1 << 20}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := decodeImage(data, tc.lim)
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("err = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestDecodeLimitsAnimatedWebP: gen2brain/webp materialises every frame, so
+// an animation must be costed per frame, and refused with ErrTooManyFrames
+// when a single frame would have fitted.
+func TestDecodeLimitsAnimatedWebP(t *testing.T) {
+	anim := &webp.WEBP{}
+	for i := 0; i < 20; i++ {
+		// Frames must differ, or the encoder merges them into a still.
+		frame := synthImage(200, 200)
+		draw.Draw(frame, image.Rect(i*10, 0, i*10+10, 200), image.NewUniform(color.Black), image.Point{}, draw.Src)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 100)
+	}
+	var buf bytes.Buffer
+	if err := webp.EncodeAll(&buf, anim, webp.Options{Quality: 50}); err != nil {
+		t.Fatal(err)
+	}
+	if got := webpFrames(buf.Bytes()); got != 20 {
+		t.Fatalf("webpFrames = %d, want 20", got)
+	}
+
+	// One frame plus working canvases is 40k px x 16 B = 640 kB.
+	_, _, err := decodeImage(buf.Bytes(), decodeLimits{memoryBytes: 2 << 20})
+	if !errors.Is(err, ErrTooManyFrames) {
+		t.Errorf("err = %v, want ErrTooManyFrames", err)
+	}
+	if _, _, err := decodeImage(buf.Bytes(), decodeLimits{memoryBytes: 16 << 20}); err != nil {
+		t.Errorf("with room for every frame: %v", err)
+	}
+}
+
+func TestWebPFramesNeverPanics(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("RIFF\x00\x00\x00\x00WEBP"),
+		[]byte("RIFF\x00\x00\x00\x00WEBPANMF\xff\xff\xff\xff"),
+		[]byte("RIFF\x00\x00\x00\x00WEBPANMF\x02\x00\x00\x00"),
+	} {
+		if got := webpFrames(data); got < 1 {
+			t.Errorf("webpFrames(%q) = %d, want >= 1", data, got)
+		}
+	}
+}
+
 // meanAbsDiff is the mean absolute per-channel difference between two images of
 // equal size, in 0-255 units.
 func meanAbsDiff(a, b image.Image) float64 {
@@ -194,3 +280,21 @@ func uniformColors(img image.Image) int {
 	}
 	return len(seen)
 }
+
+// TestHEICWarmup: the embedded warm-up image must decode as HEIC, or the
+// init-phase warm-up silently does nothing.
+func TestHEICWarmup(t *testing.T) {
+	if _, err := warmUpHEIC(); err != nil {
+		t.Fatal(err)
+	}
+	for raw, want := range map[string]bool{"": false, "true": true, "1": true, "false": false} {
+		t.Setenv("HEIC_WARMUP", raw)
+		if got, err := heicWarmupEnabled(); err != nil || got != want {
+			t.Errorf("HEIC_WARMUP=%q: enabled = %v, %v, want %v", raw, got, err, want)
+		}
+	}
+	t.Setenv("HEIC_WARMUP", "yes")
+	if _, err := heicWarmupEnabled(); err == nil {
+		t.Error("HEIC_WARMUP=yes was accepted, want an error")
+	}
+}
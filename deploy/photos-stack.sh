@@ -55,6 +55,22 @@ CLEANUP_TIMEOUT="${CLEANUP_TIMEOUT:-30}"
 DIMENSIONS="${DIMENSIONS:-}"            # "name:w,h;name:w,h"
 FORMATS="${FORMATS:-}"                  # "jpeg,webp" or "jpeg,webp,png"
 THUMB_SIZE="${THUMB_SIZE:-}"            # integer px
+PICTURE_HTML="${PICTURE_HTML:-}"        # "true" to also write picture.html
+HASHED_KEYS="${HASHED_KEYS:-}"          # "true" for content-hashed file names
+KEY_TEMPLATE="${KEY_TEMPLATE:-}"        # e.g. "{prefix}/{format}/{name}.{ext}"
+PER_FILE_OUTPUT="${PER_FILE_OUTPUT:-}"  # "true" for a folder per source file
+INCLUDE_PATTERNS="${INCLUDE_PATTERNS:-}"      # e.g. "media/images/**"
+EXCLUDE_PATTERNS="${EXCLUDE_PATTERNS:-}"      # e.g. ".DS_Store,*.txt,**/_drafts/**"
+ALLOWED_EXTENSIONS="${ALLOWED_EXTENSIONS:-}"  # e.g. "jpg,jpeg,png,webp,heic"
+OUTPUT_PREFIX="${OUTPUT_PREFIX:-}"      # e.g. "processed", if DEST_BUCKET also gets uploads
+HEIC_WARMUP="${HEIC_WARMUP:-}"          # "true" to compile the HEIC decoder at init
+MAX_PIXELS="${MAX_PIXELS:-}"            # decode limit, width x height
+MAX_INPUT_BYTES="${MAX_INPUT_BYTES:-}"  # decode limit, size of the upload
+MAX_DIMENSION="${MAX_DIMENSION:-}"      # decode limit, longest side in px
+MIN_WIDTH="${MIN_WIDTH:-}"              # acceptance rule, minimum width in px
+MIN_HEIGHT="${MIN_HEIGHT:-}"            # acceptance rule, minimum height in px
+MAX_ASPECT="${MAX_ASPECT:-}"            # acceptance rule, long side / short side
+MIN_SHARPNESS="${MIN_SHARPNESS:-}"      # acceptance rule, see the README to calibrate
 
 # Key prefix used by `verify`. It must fall inside whatever scope the execution
 # roles allow: a role whose s3:DeleteObject is restricted to, say,
@@ -123,7 +139,14 @@ purge_prefix() {
   return 0
 }
 
-# Number of objects one upload produces: dims x formats, plus orig and thumbnail.
+# is_true accepts the spellings Go's strconv.ParseBool reads as true.
+is_true() {
+  case "$1" in true|TRUE|True|1|t|T) return 0 ;; esac
+  return 1
+}
+
+# Number of objects one upload produces: dims x formats, plus orig, thumbnail,
+# meta.json and manifest.json, and picture.html when enabled.
 derivative_count() {
   local d f
   if [ -n "$DIMENSIONS" ]; then
@@ -136,7 +159,9 @@ derivative_count() {
   else
     f=2
   fi
-  echo $(( d * f + 2 ))
+  local extra=4
+  is_true "$PICTURE_HTML" && extra=5
+  echo $(( d * f + extra ))
 }
 
 # ------------------------------------------------------------------- preflight
@@ -217,15 +242,33 @@ cmd_bootstrap() {
   make_bucket "$DEST_BUCKET"
 
   step "Creating IAM execution roles"
-  # The optimizer reads originals and writes derivatives. It never deletes.
+  # The optimizer reads originals and writes derivatives. It reads back the
+  # manifest.json it wrote last time to skip redelivered events; s3:ListBucket
+  # makes a missing manifest a 404 instead of a 403. Listing the originals lets
+  # an HTTP GET find the source of a file it generates on demand. It deletes a
+  # set's rejected.json once a later upload is accepted, and otherwise only
+  # when keys contain a content hash (HASHED_KEYS, or {hash} in KEY_TEMPLATE),
+  # where it removes the files of the generation it replaced.
+  local replace=""
+  if is_true "$HASHED_KEYS" || [[ "$KEY_TEMPLATE" == *"{hash}"* ]]; then
+    replace=',
+    { "Sid": "ReplaceGenerations", "Effect": "Allow", "Action": ["s3:DeleteObject"],
+      "Resource": "arn:aws:s3:::'"${DEST_BUCKET}"'/*" }'
+  fi
   make_role "$ROLE_PHOTOS" "${PROJECT}-photos-s3" "$(cat <<JSON
 {
   "Version": "2012-10-17",
   "Statement": [
-    { "Sid": "ReadOriginals",  "Effect": "Allow", "Action": ["s3:GetObject"],
+    { "Sid": "ReadOriginals",  "Effect": "Allow", "Action": ["s3:GetObject", "s3:GetObjectVersion"],
       "Resource": "arn:aws:s3:::${SOURCE_BUCKET}/*" },
-    { "Sid": "WriteDerivatives", "Effect": "Allow", "Action": ["s3:PutObject"],
-      "Resource": "arn:aws:s3:::${DEST_BUCKET}/*" }
+    { "Sid": "FindOriginals",  "Effect": "Allow", "Action": ["s3:ListBucket"],
+      "Resource": "arn:aws:s3:::${SOURCE_BUCKET}" },
+    { "Sid": "WriteDerivatives", "Effect": "Allow", "Action": ["s3:PutObject", "s3:GetObject"],
+      "Resource": "arn:aws:s3:::${DEST_BUCKET}/*" },
+    { "Sid": "CheckManifests", "Effect": "Allow", "Action": ["s3:ListBucket"],
+      "Resource": "arn:aws:s3:::${DEST_BUCKET}" },
+    { "Sid": "ClearRejections", "Effect": "Allow", "Action": ["s3:DeleteObject"],
+      "Resource": "arn:aws:s3:::${DEST_BUCKET}/*rejected.json" }${replace}
   ]
 }
 JSON
@@ -442,21 +485,51 @@ cmd_deploy() {
   [ -f "$REPO_ROOT/cleanup-lambda.zip" ] || cmd_build
 
   # Environment for the optimizer. Only DESTINATION_BUCKET is required; the
-  # others fall back to built-in defaults when unset.
+  # others fall back to built-in defaults when unset. SOURCE_BUCKET is only
+  # read by HTTP requests, which are not tied to an event's bucket.
   local envmap
-  envmap=$(jq -nc --arg d "$DEST_BUCKET" --arg dim "$DIMENSIONS" \
-                  --arg f "$FORMATS" --arg t "$THUMB_SIZE" '
-    {Variables: ({DESTINATION_BUCKET: $d}
+  envmap=$(jq -nc --arg d "$DEST_BUCKET" --arg s "$SOURCE_BUCKET" --arg dim "$DIMENSIONS" \
+                  --arg f "$FORMATS" --arg t "$THUMB_SIZE" --arg p "$PICTURE_HTML" \
+                  --arg hk "$HASHED_KEYS" --arg kt "$KEY_TEMPLATE" --arg pf "$PER_FILE_OUTPUT" \
+                  --arg inc "$INCLUDE_PATTERNS" --arg exc "$EXCLUDE_PATTERNS" --arg ext "$ALLOWED_EXTENSIONS" \
+                  --arg op "$OUTPUT_PREFIX" --arg hw "$HEIC_WARMUP" \
+                  --arg mpx "$MAX_PIXELS" --arg mib "$MAX_INPUT_BYTES" --arg mdm "$MAX_DIMENSION" \
+                  --arg mnw "$MIN_WIDTH" --arg mnh "$MIN_HEIGHT" --arg mxa "$MAX_ASPECT" \
+                  --arg msh "$MIN_SHARPNESS" '
+    {Variables: ({DESTINATION_BUCKET: $d, SOURCE_BUCKET: $s}
       + (if $dim != "" then {DIMENSIONS: $dim} else {} end)
       + (if $f   != "" then {FORMATS: $f}      else {} end)
-      + (if $t   != "" then {THUMB_SIZE: $t}   else {} end))}')
-
-  # The cleaner deletes one ListObjectsV2 page and does not paginate, so
-  # MAX_KEYS must cover a whole derivative set or folders are cleaned partially.
+      + (if $t   != "" then {THUMB_SIZE: $t}   else {} end)
+      + (if $p   != "" then {PICTURE_HTML: $p} else {} end)
+      + (if $hk  != "" then {HASHED_KEYS: $hk} else {} end)
+      + (if $kt  != "" then {KEY_TEMPLATE: $kt} else {} end)
+      + (if $pf  != "" then {PER_FILE_OUTPUT: $pf} else {} end)
+      + (if $inc != "" then {INCLUDE_PATTERNS: $inc} else {} end)
+      + (if $exc != "" then {EXCLUDE_PATTERNS: $exc} else {} end)
+      + (if $ext != "" then {ALLOWED_EXTENSIONS: $ext} else {} end)
+      + (if $op  != "" then {OUTPUT_PREFIX: $op} else {} end)
+      + (if $hw  != "" then {HEIC_WARMUP: $hw} else {} end)
+      + (if $mpx != "" then {MAX_PIXELS: $mpx} else {} end)
+      + (if $mib != "" then {MAX_INPUT_BYTES: $mib} else {} end)
+      + (if $mdm != "" then {MAX_DIMENSION: $mdm} else {} end)
+      + (if $mnw != "" then {MIN_WIDTH: $mnw} else {} end)
+      + (if $mnh != "" then {MIN_HEIGHT: $mnh} else {} end)
+      + (if $mxa != "" then {MAX_ASPECT: $mxa} else {} end)
+      + (if $msh != "" then {MIN_SHARPNESS: $msh} else {} end))}')
+
+  # The cleaner works out which files a deleted original owns from the same
+  # key settings as the optimizer, so both get HASHED_KEYS, KEY_TEMPLATE and
+  # PER_FILE_OUTPUT.
+  # MAX_KEYS is its ListObjectsV2 page size; it paginates, so one set per page
+  # is only an optimisation.
   local maxkeys; maxkeys=$(derivative_count)
   local cleanup_envmap
   cleanup_envmap=$(jq -nc --arg d "$DEST_BUCKET" --arg m "$maxkeys" \
-    '{Variables: {DESTINATION_BUCKET: $d, MAX_KEYS: $m}}')
+                          --arg hk "$HASHED_KEYS" --arg kt "$KEY_TEMPLATE" --arg pf "$PER_FILE_OUTPUT" '
+    {Variables: ({DESTINATION_BUCKET: $d, MAX_KEYS: $m}
+      + (if $hk != "" then {HASHED_KEYS: $hk} else {} end)
+      + (if $kt != "" then {KEY_TEMPLATE: $kt} else {} end)
+      + (if $pf != "" then {PER_FILE_OUTPUT: $pf} else {} end))}')
 
   step "Deploying functions"
   upsert_function "$FN_PHOTOS"  "$rp" "$REPO_ROOT/photos-lambda.zip"  "$MEMORY" "$TIMEOUT" "$envmap"
@@ -482,6 +555,14 @@ cmd_verify() {
   require_config
   local prefix="${VERIFY_PREFIX%/}/$$"
   local want; want=$(derivative_count)
+  # verify counts files under the upload's own folder, which is where the
+  # default layout puts them.
+  case "$KEY_TEMPLATE" in
+    ""|"{prefix}/"*) ;;
+    *) die "verify expects files under {prefix}/; KEY_TEMPLATE=$KEY_TEMPLATE puts them elsewhere" ;;
+  esac
+  local out="$prefix"
+  is_true "$PER_FILE_OUTPUT" && out="$prefix/orig"
   local tmp; tmp=$(mktemp -d)
   # Expand $tmp now, not at trap time: it is a local and would be out of scope
   # when the trap fires, which trips `set -u`.
@@ -549,8 +630,8 @@ GO
 
   step "Checking Content-Type and Cache-Control"
   local ct cc
-  ct=$(aws_ s3api head-object --bucket "$DEST_BUCKET" --key "$prefix/orig.jpeg" --query ContentType --output text)
-  cc=$(aws_ s3api head-object --bucket "$DEST_BUCKET" --key "$prefix/orig.jpeg" --query CacheControl --output text)
+  ct=$(aws_ s3api head-object --bucket "$DEST_BUCKET" --key "$out/orig.jpeg" --query ContentType --output text)
+  cc=$(aws_ s3api head-object --bucket "$DEST_BUCKET" --key "$out/orig.jpeg" --query CacheControl --output text)
   info "orig.jpeg  Content-Type: $ct  Cache-Control: $cc"
   [ "$ct" = "image/jpeg" ] || warn "unexpected Content-Type: $ct"
 
@@ -571,7 +652,8 @@ GO
     warn "Two things cause this:"
     warn "  1. VERIFY_PREFIX ($VERIFY_PREFIX) is outside the scope the cleanup"
     warn "     role allows s3:DeleteObject on. Check the log for AccessDenied."
-    warn "  2. MAX_KEYS is lower than $want, so only part of the set is removed."
+    warn "  2. KEY_TEMPLATE or HASHED_KEYS differ between the two functions, so"
+    warn "     the cleaner does not recognise the files as the original's."
     warn "  aws logs tail /aws/lambda/$FN_CLEANUP --since 5m"
     purge_prefix "$DEST_BUCKET" "$prefix/"
     die "cleanup verification failed"
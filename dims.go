@@ -9,7 +9,8 @@ import (
 
 // getDefaultDims maps CSS breakpoint names to the maximum box for that
 // breakpoint. The keys become the output filenames and are mirrored in the
-// Django app as recipes.models.SCREEN_SIZES -- keep the two in sync.
+// Django app as recipes.models.SCREEN_SIZES -- keep the two in sync until the
+// app reads them from manifest.json instead.
 func getDefaultDims() map[string]ImageSize {
 	return map[string]ImageSize{
 		"1200": {Width: 1090, Height: 818},
@@ -48,6 +49,11 @@ func parseDims(dimStr string) (map[string]ImageSize, error) {
 		if name == "" {
 			return nil, fmt.Errorf("invalid dimension %q: empty name", spec)
 		}
+		// Names end up in keys between dots and slashes; the cleanup function
+		// relies on them holding neither to tell one photo's files from another's.
+		if strings.ContainsAny(name, "./") {
+			return nil, fmt.Errorf("invalid dimension %q: name must not contain . or /", spec)
+		}
 		wStr, hStr, found := strings.Cut(sizes, ",")
 		if !found {
 			return nil, fmt.Errorf("invalid dimension %q: expected width,height", spec)
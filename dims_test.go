@@ -101,7 +101,7 @@ func TestParseDims(t *testing.T) {
 			t.Errorf("got %v, want %v", got, want)
 		}
 	})
-	for _, bad := range []string{"web", "web:800", "web:800,abc", "web:0,600", "web:-1,600", ":800,600"} {
+	for _, bad := range []string{"web", "web:800", "web:800,abc", "web:0,600", "web:-1,600", ":800,600", "1.5x:800,600", "a/b:800,600"} {
 		t.Run("rejects "+bad, func(t *testing.T) {
 			if _, err := parseDims(bad); err == nil {
 				t.Errorf("parseDims(%q) succeeded, want error", bad)
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// defaultDupeThreshold is the largest Hamming distance between two pHashes
+// still reported as the same photo. Re-encodes and resizes land within a few
+// bits; unrelated photos sit around 32.
+const defaultDupeThreshold = 10
+
+// hashedImage is one photo in a duplicate scan. Source is the file, or the
+// directory / key prefix of a published set.
+type hashedImage struct {
+	Source string
+	Hash   uint64
+}
+
+// sourceExtensions are the files a directory scan decodes. Anything else is
+// skipped without being read.
+var sourceExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".webp": true, ".heic": true, ".heif": true,
+}
+
+// scanDirectory hashes every image under dir. A directory holding a
+// manifest.json is a generated set: its hash is read from the manifest and its
+// other files are skipped, or every derivative would match every other.
+// Files that fail to decode are reported to warn and skipped.
+func scanDirectory(dir string, lim decodeLimits, warn io.Writer) ([]hashedImage, error) {
+	var out []hashedImage
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			data, err := os.ReadFile(filepath.Join(path, manifestName+".json"))
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			h, err := manifestHash(data)
+			if err != nil {
+				fmt.Fprintf(warn, "skipping %s: %v\n", path, err)
+			} else {
+				out = append(out, hashedImage{Source: path, Hash: h})
+			}
+			return filepath.SkipDir
+		}
+		if !sourceExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		img, _, err := decodeImage(data, lim)
+		if err != nil {
+			fmt.Fprintf(warn, "skipping %s: %v\n", path, err)
+			return nil
+		}
+		out = append(out, hashedImage{Source: path, Hash: hashImage(img)})
+		releaseImage(img)
+		return nil
+	})
+	return out, err
+}
+
+// scanBucket reads the hash of every published set under prefix from its
+// manifest.json, so nothing is decoded. Sets generated before the hash
+// existed have none and are reported to warn; reprocess them to include them.
+func scanBucket(ctx context.Context, client s3API, bucket, prefix string, warn io.Writer) ([]hashedImage, error) {
+	var out []hashedImage
+	in := &s3.ListObjectsV2Input{Bucket: aws.String(bucket)}
+	if prefix != "" {
+		in.Prefix = aws.String(prefix)
+	}
+	for {
+		page, err := client.ListObjectsV2(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("listing s3://%s/%s: %w", bucket, prefix, err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			dir, name, err := splitKey(key)
+			if err != nil || name != manifestName+".json" {
+				continue
+			}
+			data, err := downloadImage(ctx, client, bucket, key)
+			if err != nil {
+				return nil, err
+			}
+			h, err := manifestHash(data)
+			if err != nil {
+				fmt.Fprintf(warn, "skipping s3://%s/%s: %v\n", bucket, key, err)
+				continue
+			}
+			out = append(out, hashedImage{Source: "s3://" + bucket + "/" + dir, Hash: h})
+		}
+		if !aws.ToBool(page.IsTruncated) {
+			return out, nil
+		}
+		in.ContinuationToken = page.NextContinuationToken
+	}
+}
+
+// manifestHash reads the perceptual hash out of a manifest.json.
+func manifestHash(data []byte) (uint64, error) {
+	m, err := parseManifest(data)
+	if err != nil {
+		return 0, err
+	}
+	if m.Analysis.PHash == "" {
+		return 0, errors.New("manifest has no perceptual hash")
+	}
+	return parseHash(m.Analysis.PHash)
+}
+
+// clusterByHash groups images whose hashes are within threshold bits of each
+// other, transitively, and returns every group of two or more. Groups are
+// ordered by their first source and members by source, so output is stable
+// across runs.
+func clusterByHash(images []hashedImage, threshold int) [][]hashedImage {
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			if hammingDistance(images[i].Hash, images[j].Hash) <= threshold {
+				parent[find(i)] = find(j)
+			}
+		}
+	}
+
+	groups := map[int][]hashedImage{}
+	for i, img := range images {
+		root := find(i)
+		groups[root] = append(groups[root], img)
+	}
+	var out [][]hashedImage
+	for _, g := range groups {
+		if len(g) < 2 {
+			continue
+		}
+		sort.Slice(g, func(i, j int) bool { return g[i].Source < g[j].Source })
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0].Source < out[j][0].Source })
+	return out
+}
+
+// runDupes implements the "dupes" subcommand:
+//
+//	photos dupes [-threshold N] <directory | s3://bucket/prefix>
+//
+// It prints one block per cluster of near-duplicates, each member with its
+// distance from the first.
+func runDupes(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fset := flag.NewFlagSet("dupes", flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	threshold := fset.Int("threshold", defaultDupeThreshold, "Maximum Hamming distance (0-64) between near-duplicates")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return errors.New("dupes takes exactly one directory or s3://bucket/prefix")
+	}
+	if *threshold < 0 || *threshold > 64 {
+		return fmt.Errorf("-threshold: %d is outside 0-64", *threshold)
+	}
+
+	target := fset.Arg(0)
+	var images []hashedImage
+	if rest, ok := strings.CutPrefix(target, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if bucket == "" {
+			return fmt.Errorf("%q has no bucket name", target)
+		}
+		awsCfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return fmt.Errorf("AWS configuration: %w", err)
+		}
+		if images, err = scanBucket(ctx, s3.NewFromConfig(awsCfg), bucket, prefix, stderr); err != nil {
+			return err
+		}
+	} else {
+		limits, err := loadLimits()
+		if err != nil {
+			return err
+		}
+		if images, err = scanDirectory(target, limits, stderr); err != nil {
+			return err
+		}
+	}
+
+	clusters := clusterByHash(images, *threshold)
+	for i, c := range clusters {
+		fmt.Fprintf(stdout, "cluster %d (%d images):\n", i+1, len(c))
+		for _, img := range c {
+			fmt.Fprintf(stdout, "  %s  %s  distance %d\n", formatHash(img.Hash), img.Source, hammingDistance(c[0].Hash, img.Hash))
+		}
+	}
+	fmt.Fprintf(stdout, "%d images scanned, %d clusters of near-duplicates\n", len(images), len(clusters))
+	return nil
+}
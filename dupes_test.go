@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClusterByHash(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		images    []hashedImage
+		threshold int
+		want      [][]string
+	}{
+		{"none", nil, 10, nil},
+		{"all distinct", []hashedImage{{"a", 0}, {"b", ^uint64(0)}}, 10, nil},
+		{"pair", []hashedImage{{"b", 0b111}, {"a", 0}, {"c", ^uint64(0)}}, 3, [][]string{{"a", "b"}}},
+		{"just over", []hashedImage{{"a", 0}, {"b", 0b1111}}, 3, nil},
+		// a~b and b~c join a and c even though they are 6 bits apart.
+		{"transitive", []hashedImage{{"c", 0b111111}, {"a", 0}, {"b", 0b111}}, 3, [][]string{{"a", "b", "c"}}},
+		{"two groups", []hashedImage{{"z", ^uint64(0)}, {"x", 0}, {"y", ^uint64(1)}, {"w", 1}}, 2, [][]string{{"w", "x"}, {"y", "z"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got [][]string
+			for _, c := range clusterByHash(tc.images, tc.threshold) {
+				var names []string
+				for _, img := range c {
+					names = append(names, img.Source)
+				}
+				got = append(got, names)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func copyFixture(t *testing.T, from, to string) {
+	t.Helper()
+	data, err := os.ReadFile(from)
+	if err != nil {
+		t.Skipf("fixture %s missing: %v", from, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(to, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func manifestWithHash(t *testing.T, phash string) []byte {
+	t.Helper()
+	data, err := json.Marshal(Manifest{Analysis: Analysis{PHash: phash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestScanDirectory: rotated copies cluster, a generated set is read from its
+// manifest rather than from its dozen derivatives, and non-images are skipped.
+func TestScanDirectory(t *testing.T) {
+	dir := t.TempDir()
+	copyFixture(t, "testdata/orientation/landscape_1.jpg", filepath.Join(dir, "bread.jpg"))
+	copyFixture(t, "testdata/orientation/landscape_6.jpg", filepath.Join(dir, "uploads", "bread-rotated.JPG"))
+	copyFixture(t, "testdata/test.heic", filepath.Join(dir, "soup.heic"))
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken.png"), []byte("not a png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bread, _ := hashFixture(t, "testdata/orientation/landscape_1.jpg")
+	set := filepath.Join(dir, "tags", "bread")
+	copyFixture(t, "testdata/orientation/portrait_1.jpg", filepath.Join(set, "1200.jpeg")) // must be skipped
+	if err := os.WriteFile(filepath.Join(set, "manifest.json"), manifestWithHash(t, formatHash(bread)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var warn bytes.Buffer
+	images, err := scanDirectory(dir, decodeLimits{}, &warn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 4 {
+		t.Errorf("scanned %d images, want 4: %+v", len(images), images)
+	}
+	if !strings.Contains(warn.String(), "broken.png") {
+		t.Errorf("the undecodable file was not reported: %q", warn.String())
+	}
+
+	clusters := clusterByHash(images, defaultDupeThreshold)
+	if len(clusters) != 1 || len(clusters[0]) != 3 {
+		t.Fatalf("clusters = %+v, want the three breads together", clusters)
+	}
+	for _, img := range clusters[0] {
+		if strings.Contains(img.Source, "soup") {
+			t.Errorf("%s clustered with the bread", img.Source)
+		}
+	}
+}
+
+func TestScanBucket(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{
+		"media/a/manifest.json": manifestWithHash(t, "00000000000000ff"),
+		"media/a/1200.jpeg":     []byte("jpeg"),
+		"media/b/manifest.json": manifestWithHash(t, "00000000000000fe"),
+		"media/c/manifest.json": manifestWithHash(t, ""), // generated before pHash
+		"media/d/manifest.json": manifestWithHash(t, "ff00000000000000"),
+		"other/e/manifest.json": manifestWithHash(t, "00000000000000ff"),
+	}}
+	var warn bytes.Buffer
+	images, err := scanBucket(context.Background(), fake, "dest", "media/", &warn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []hashedImage{
+		{"s3://dest/media/a", 0xff},
+		{"s3://dest/media/b", 0xfe},
+		{"s3://dest/media/d", 0xff00000000000000},
+	}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("got %+v, want %+v", images, want)
+	}
+	if !strings.Contains(warn.String(), "media/c/manifest.json") {
+		t.Errorf("the hashless manifest was not reported: %q", warn.String())
+	}
+}
+
+func TestRunDupes(t *testing.T) {
+	dir := t.TempDir()
+	copyFixture(t, "testdata/orientation/portrait_1.jpg", filepath.Join(dir, "a.jpg"))
+	copyFixture(t, "testdata/orientation/portrait_3.jpg", filepath.Join(dir, "b.jpg"))
+
+	var out, errOut bytes.Buffer
+	if err := runDupes(context.Background(), []string{"-threshold", "4", dir}, &out, &errOut); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "cluster 1 (2 images)") || !strings.Contains(out.String(), "2 images scanned, 1 clusters") {
+		t.Errorf("output:\n%s", out.String())
+	}
+
+	for _, args := range [][]string{nil, {"a", "b"}, {"-threshold", "65", dir}, {"s3://"}} {
+		if err := runDupes(context.Background(), args, &out, &errOut); err == nil {
+			t.Errorf("runDupes(%q) succeeded", args)
+		}
+	}
+}
@@ -27,23 +27,27 @@ const (
 //
 // This function is the swap seam for the encoder stack: replacing
 // gen2brain/webp with another CGo-free encoder means changing only this file.
+//
+// Rendering goes through a pooled buffer, which saves the repeated growth of a
+// fresh one; the result is copied out so the buffer can be reused.
 func encode(img image.Image, format ImageFormat, quality int) ([]byte, error) {
-	var buf bytes.Buffer
+	buf := getBuffer()
+	defer putBuffer(buf)
 	switch format {
 	case FormatJPEG:
-		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
 			return nil, fmt.Errorf("encoding jpeg: %w", err)
 		}
 	case FormatWEBP:
-		if err := webp.Encode(&buf, img, webp.Options{Quality: quality, Method: webpMethod}); err != nil {
+		if err := webp.Encode(buf, img, webp.Options{Quality: quality, Method: webpMethod}); err != nil {
 			return nil, fmt.Errorf("encoding webp: %w", err)
 		}
 	case FormatPNG:
-		if err := png.Encode(&buf, img); err != nil {
+		if err := png.Encode(buf, img); err != nil {
 			return nil, fmt.Errorf("encoding png: %w", err)
 		}
 	default:
 		return nil, fmt.Errorf("cannot encode format %v", format)
 	}
-	return buf.Bytes(), nil
+	return bytes.Clone(buf.Bytes()), nil
 }
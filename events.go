@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// objectRecord is one created source object, whichever notification
+// announced it. Key is already decoded.
+type objectRecord struct {
+	Bucket    string
+	Key       string
+	Size      int64
+	ETag      string
+	VersionID string
+}
+
+// fromS3Record normalises a classic S3 notification record. S3 URL-encodes
+// object keys in these (a space arrives as "+"); without decoding, GetObject
+// 404s on any key containing one.
+func fromS3Record(rec events.S3EventRecord) (objectRecord, error) {
+	key, err := url.QueryUnescape(rec.S3.Object.Key)
+	if err != nil {
+		return objectRecord{}, fmt.Errorf("decoding object key %q: %w", rec.S3.Object.Key, err)
+	}
+	return objectRecord{
+		Bucket:    rec.S3.Bucket.Name,
+		Key:       key,
+		Size:      rec.S3.Object.Size,
+		ETag:      rec.S3.Object.ETag,
+		VersionID: rec.S3.Object.VersionID,
+	}, nil
+}
+
+// eventBridgeDetail is the detail of an EventBridge "Object Created" event.
+// Unlike classic notifications, its keys are not URL-encoded.
+type eventBridgeDetail struct {
+	Bucket struct {
+		Name string `json:"name"`
+	} `json:"bucket"`
+	Object struct {
+		Key       string `json:"key"`
+		Size      int64  `json:"size"`
+		ETag      string `json:"etag"`
+		VersionID string `json:"version-id"`
+	} `json:"object"`
+}
+
+// objectCreated is the detail-type of the only EventBridge events processed.
+const objectCreated = "Object Created"
+
+// ignoredEventBridge reports, and logs, an EventBridge event other than
+// "Object Created", such as "Object Deleted" from a broad rule. It is
+// acknowledged wherever it arrives, since retrying it cannot help.
+func ignoredEventBridge(ev events.CloudWatchEvent) bool {
+	if ev.DetailType == objectCreated {
+		return false
+	}
+	fmt.Printf("Ignoring EventBridge %q event\n", ev.DetailType)
+	return true
+}
+
+// fromEventBridge normalises an EventBridge "Object Created" event.
+func fromEventBridge(ev events.CloudWatchEvent) (objectRecord, error) {
+	if ev.Source != "aws.s3" || ev.DetailType != objectCreated {
+		return objectRecord{}, fmt.Errorf("unsupported EventBridge event %q from %q", ev.DetailType, ev.Source)
+	}
+	var d eventBridgeDetail
+	if err := json.Unmarshal(ev.Detail, &d); err != nil {
+		return objectRecord{}, fmt.Errorf("reading EventBridge detail: %w", err)
+	}
+	if d.Bucket.Name == "" || d.Object.Key == "" {
+		return objectRecord{}, errors.New("EventBridge detail has no bucket or object key")
+	}
+	return objectRecord{
+		Bucket:    d.Bucket.Name,
+		Key:       d.Object.Key,
+		Size:      d.Object.Size,
+		ETag:      d.Object.ETag,
+		VersionID: d.Object.VersionID,
+	}, nil
+}
+
+// The payload shapes one binary accepts.
+const (
+	payloadS3          = "s3"
+	payloadSQS         = "sqs"
+	payloadEventBridge = "eventbridge"
+	payloadReprocess   = "reprocess"
+	payloadBatchJob    = "batchjob"
+	payloadHTTP        = "http"
+)
+
+// sniffPayload tells the payload shapes apart by the fields that identify
+// them: S3 and SQS events are both a Records array, told apart by each
+// record's eventSource; EventBridge events have a detail-type; S3 Batch
+// Operations send an invocationSchemaVersion; function URL and HTTP API
+// requests have a requestContext.http; direct invocations such as
+// ReprocessRequest have an action.
+func sniffPayload(payload []byte) (string, error) {
+	var probe struct {
+		Records []struct {
+			EventSource string `json:"eventSource"`
+		} `json:"Records"`
+		DetailType string `json:"detail-type"`
+		Source     string `json:"source"`
+		Action     string `json:"action"`
+		Schema     string `json:"invocationSchemaVersion"`
+		Context    struct {
+			HTTP struct {
+				Method string `json:"method"`
+			} `json:"http"`
+		} `json:"requestContext"`
+	}
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return "", fmt.Errorf("reading event: %w", err)
+	}
+	switch {
+	case len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:s3":
+		return payloadS3, nil
+	case len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:sqs":
+		return payloadSQS, nil
+	case probe.DetailType != "" && probe.Source == "aws.s3":
+		return payloadEventBridge, nil
+	case probe.Schema != "":
+		return payloadBatchJob, nil
+	case probe.Context.HTTP.Method != "":
+		return payloadHTTP, nil
+	case probe.Action != "":
+		return payloadReprocess, nil
+	}
+	return "", errors.New("unrecognised event: not an S3 notification, SQS batch, S3 EventBridge event, batch job, HTTP request or action")
+}
+
+// parseNotification reads the object records out of an S3 notification or an
+// EventBridge event, the two things an SQS message body can hold. S3's
+// s3:TestEvent, sent when a notification is configured, holds none, and so
+// does an EventBridge event other than "Object Created".
+func parseNotification(body []byte) ([]objectRecord, error) {
+	kind, err := sniffPayload(body)
+	if err != nil {
+		var probe struct{ Event string }
+		if json.Unmarshal(body, &probe) == nil && probe.Event == "s3:TestEvent" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	switch kind {
+	case payloadS3:
+		var event events.S3Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			return nil, fmt.Errorf("reading S3 notification: %w", err)
+		}
+		out := make([]objectRecord, 0, len(event.Records))
+		for _, rec := range event.Records {
+			r, err := fromS3Record(rec)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, r)
+		}
+		return out, nil
+	case payloadEventBridge:
+		var ev events.CloudWatchEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			return nil, fmt.Errorf("reading EventBridge event: %w", err)
+		}
+		if ignoredEventBridge(ev) {
+			return nil, nil
+		}
+		r, err := fromEventBridge(ev)
+		if err != nil {
+			return nil, err
+		}
+		return []objectRecord{r}, nil
+	}
+	return nil, fmt.Errorf("unexpected %s payload in a message body", kind)
+}
+
+// Dispatch is the Lambda entry point. It accepts classic S3 notifications,
+// EventBridge "Object Created" events and SQS batches of either, so the same
+// function can sit behind any of them, as well as S3 Batch Operations jobs,
+// function URL requests and direct reprocess requests, and returns what the
+// matching handler returns.
+func Dispatch(ctx context.Context, payload json.RawMessage) (any, error) {
+	kind, err := sniffPayload(payload)
+	if err != nil {
+		return "Error", err
+	}
+	switch kind {
+	case payloadS3:
+		var event events.S3Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return "Error", fmt.Errorf("reading S3 notification: %w", err)
+		}
+		return Handler(ctx, event)
+	case payloadSQS:
+		var event events.SQSEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return "Error", fmt.Errorf("reading SQS event: %w", err)
+		}
+		return SQSHandler(ctx, event)
+	case payloadReprocess:
+		req, err := parseReprocessRequest(payload)
+		if err != nil {
+			return Summary{}, err
+		}
+		return ReprocessHandler(ctx, req)
+	case payloadBatchJob:
+		var event BatchJobEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return "Error", fmt.Errorf("reading batch job event: %w", err)
+		}
+		return BatchJobHandler(ctx, event)
+	case payloadHTTP:
+		var req events.LambdaFunctionURLRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return "Error", fmt.Errorf("reading HTTP request: %w", err)
+		}
+		return HTTPHandler(ctx, req)
+	default:
+		var event events.CloudWatchEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return "Error", fmt.Errorf("reading EventBridge event: %w", err)
+		}
+		return EventBridgeHandler(ctx, event)
+	}
+}
+
+// EventBridgeHandler processes an EventBridge "Object Created" event. Other
+// S3 events a broad rule might send are logged and acknowledged, since
+// retrying them cannot help.
+func EventBridgeHandler(ctx context.Context, event events.CloudWatchEvent) (Summary, error) {
+	if ignoredEventBridge(event) {
+		return Summary{}, nil
+	}
+	rec, err := fromEventBridge(event)
+	if err != nil {
+		return Summary{}, err
+	}
+	cfg, client, err := setup(ctx)
+	if err != nil {
+		return Summary{}, err
+	}
+	var summary Summary
+	result, err := attemptRecord(ctx, client, cfg, rec)
+	summary.add(result)
+	return summary, err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	testS3Notification = `{"Records":[{"eventSource":"aws:s3","eventName":"ObjectCreated:Put",
+		"s3":{"bucket":{"name":"src"},"object":{"key":"tags/my+bread/orig%281%29.jpg","size":1234,"eTag":"abc","versionId":"v1"}}}]}`
+	testEventBridge = `{"version":"0","id":"1","detail-type":"Object Created","source":"aws.s3","account":"123","region":"us-east-1",
+		"detail":{"version":"0","bucket":{"name":"src"},"object":{"key":"tags/my+bread/orig(1).jpg","size":1234,"etag":"abc","version-id":"v1"},"reason":"PutObject"}}`
+	testEventBridgeDeleted = `{"detail-type":"Object Deleted","source":"aws.s3",
+		"detail":{"bucket":{"name":"src"},"object":{"key":"tags/bread/orig.jpg"}}}`
+	testS3TestEvent = `{"Service":"Amazon S3","Event":"s3:TestEvent","Time":"2026-01-01T00:00:00.000Z","Bucket":"src"}`
+)
+
+func TestSniffPayload(t *testing.T) {
+	for _, tc := range []struct {
+		name, payload, want string
+		wantErr             bool
+	}{
+		{"s3", testS3Notification, payloadS3, false},
+		{"sqs", `{"Records":[{"messageId":"1","eventSource":"aws:sqs","body":"{}"}]}`, payloadSQS, false},
+		{"eventbridge", testEventBridge, payloadEventBridge, false},
+		{"eventbridge from another service", `{"detail-type":"EC2 Instance State-change Notification","source":"aws.ec2"}`, "", true},
+		{"empty records", `{"Records":[]}`, "", true},
+		{"sns", `{"Records":[{"EventSource":"aws:sns"}]}`, "", true},
+		{"not json", `{"Records":`, "", true},
+		{"test event", testS3TestEvent, "", true},
+		{"reprocess", `{"action":"reprocess","bucket":"src","keys":["a/b.jpg"]}`, payloadReprocess, false},
+		{"batch job", `{"invocationSchemaVersion":"1.0","invocationId":"x","job":{"id":"j"},"tasks":[]}`, payloadBatchJob, false},
+		{"function url", `{"version":"2.0","rawPath":"/a/400.webp","requestContext":{"http":{"method":"GET","path":"/a/400.webp"}}}`, payloadHTTP, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := sniffPayload([]byte(tc.payload))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("sniffPayload() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Errorf("sniffPayload() = %q, %v, want %q", got, err, tc.want)
+			}
+		})
+	}
+}
+
+// TestParseNotification: both notification styles normalise to the same
+// record, decoding the key only where S3 encoded it.
+func TestParseNotification(t *testing.T) {
+	want := []objectRecord{{Bucket: "src", Key: "tags/my bread/orig(1).jpg", Size: 1234, ETag: "abc", VersionID: "v1"}}
+	wantEB := []objectRecord{{Bucket: "src", Key: "tags/my+bread/orig(1).jpg", Size: 1234, ETag: "abc", VersionID: "v1"}}
+	for _, tc := range []struct {
+		name, body string
+		want       []objectRecord
+		wantErr    bool
+	}{
+		{"s3", testS3Notification, want, false},
+		{"eventbridge", testEventBridge, wantEB, false},
+		{"test event", testS3TestEvent, nil, false},
+		{"deleted", testEventBridgeDeleted, nil, false}, // acknowledged, not retried
+		{"malformed", `{not json`, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseNotification([]byte(tc.body))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDispatchRejectsUnknownPayload(t *testing.T) {
+	if _, err := Dispatch(context.Background(), json.RawMessage(`{"hello":"world"}`)); err == nil {
+		t.Error("Dispatch accepted an unrecognised payload")
+	}
+}
+
+// TestEventBridgeHandlerIgnoresOtherEvents: a rule matching every S3 event
+// must not make deletions fail and retry.
+func TestEventBridgeHandlerIgnoresOtherEvents(t *testing.T) {
+	var ev events.CloudWatchEvent
+	if err := json.Unmarshal([]byte(testEventBridgeDeleted), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := EventBridgeHandler(context.Background(), ev); err != nil || len(res.Records) != 0 {
+		t.Errorf("EventBridgeHandler(Object Deleted) = %+v, %v, want an empty summary", res, err)
+	}
+}
+
+// TestHandleSQSEventBridgeBody: a queue fed by an EventBridge rule carries the
+// EventBridge event as the message body.
+func TestHandleSQSEventBridgeBody(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{"tags/my+bread/orig(1).jpg": testPNG(t, 800, 600)}}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64}
+	resp := handleSQS(context.Background(), fake, cfg, events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "1", Body: testEventBridge},
+	}})
+	if len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("failures: %+v", resp.BatchItemFailures)
+	}
+	if fake.bodies["tags/my+bread/manifest.json"] == nil {
+		t.Error("manifest.json was not uploaded")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// keyFilter decides which source keys are worth downloading. Buckets collect
+// .DS_Store files, notes and drafts folders alongside the photos, and each of
+// those would otherwise cost a download and a decode failure.
+type keyFilter struct {
+	include    []keyPattern
+	exclude    []keyPattern
+	extensions map[string]bool // lowercased, without the dot; nil allows any
+}
+
+// keyPattern is one glob of INCLUDE_PATTERNS or EXCLUDE_PATTERNS.
+type keyPattern struct {
+	raw string
+	re  *regexp.Regexp
+}
+
+// parseKeyPattern compiles a glob. * and ? match within one path segment and
+// ** across any number of them, so "**/_drafts/**" matches a _drafts folder at
+// any depth. A pattern without a slash matches the file name alone, so
+// ".DS_Store" and "*.txt" need no leading "**/".
+func parseKeyPattern(raw string) (keyPattern, error) {
+	if raw == "" {
+		return keyPattern{}, fmt.Errorf("empty pattern")
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(raw); i++ {
+		switch {
+		case strings.HasPrefix(raw[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(raw[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case raw[i] == '*':
+			b.WriteString("[^/]*")
+		case raw[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(raw[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return keyPattern{}, fmt.Errorf("pattern %q: %w", raw, err)
+	}
+	return keyPattern{raw: raw, re: re}, nil
+}
+
+func (p keyPattern) match(key string) bool {
+	if !strings.Contains(p.raw, "/") {
+		key = path.Base(key)
+	}
+	return p.re.MatchString(key)
+}
+
+// loadKeyFilter reads INCLUDE_PATTERNS and EXCLUDE_PATTERNS, comma-separated
+// globs, and ALLOWED_EXTENSIONS, e.g. "jpg,jpeg,png,heic". All are optional;
+// unset, every key is processed.
+func loadKeyFilter() (keyFilter, error) {
+	var f keyFilter
+	var err error
+	if f.include, err = parseKeyPatterns(os.Getenv("INCLUDE_PATTERNS")); err != nil {
+		return f, fmt.Errorf("INCLUDE_PATTERNS: %w", err)
+	}
+	if f.exclude, err = parseKeyPatterns(os.Getenv("EXCLUDE_PATTERNS")); err != nil {
+		return f, fmt.Errorf("EXCLUDE_PATTERNS: %w", err)
+	}
+	if f.extensions, err = parseExtensions(os.Getenv("ALLOWED_EXTENSIONS")); err != nil {
+		return f, fmt.Errorf("ALLOWED_EXTENSIONS: %w", err)
+	}
+	return f, nil
+}
+
+func parseKeyPatterns(raw string) ([]keyPattern, error) {
+	var out []keyPattern
+	for _, s := range strings.Split(raw, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := parseKeyPattern(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func parseExtensions(raw string) (map[string]bool, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	out := map[string]bool{}
+	for _, ext := range strings.Split(raw, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext == "" {
+			continue
+		}
+		if strings.ContainsAny(ext, "./") {
+			return nil, fmt.Errorf("invalid extension %q", ext)
+		}
+		out[ext] = true
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no extensions in %q", raw)
+	}
+	return out, nil
+}
+
+// skip returns why key should not be processed, or "" to process it. Excludes
+// win over includes.
+func (f keyFilter) skip(key string) string {
+	for _, p := range f.exclude {
+		if p.match(key) {
+			return fmt.Sprintf("matches EXCLUDE_PATTERNS %q", p.raw)
+		}
+	}
+	if f.extensions != nil {
+		ext := strings.ToLower(strings.TrimPrefix(path.Ext(key), "."))
+		if !f.extensions[ext] {
+			return fmt.Sprintf("extension %q is not in ALLOWED_EXTENSIONS", ext)
+		}
+	}
+	if len(f.include) == 0 {
+		return ""
+	}
+	for _, p := range f.include {
+		if p.match(key) {
+			return ""
+		}
+	}
+	return "matches no INCLUDE_PATTERNS"
+}
@@ -6,8 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -19,20 +19,32 @@ import (
 
 const defaultThumbSize = 128
 
-// cacheControl is safe to set aggressively: a derivative's key is determined by
-// the folder it lives in, and a re-upload always overwrites the same keys.
+// cacheControl is set aggressively on every image. With content-hashed file
+// names (HASHED_KEYS) that is exactly right. With the default plain names a
+// replaced photo overwrites the same keys, and caches keep the old image until
+// they expire; the site has to bust them itself.
 const cacheControl = "public, max-age=31536000, immutable"
 
+// metadataCacheControl is for the JSON and HTML files. They describe the
+// current set and are read by the site's backend, so they must never be served
+// stale.
+const metadataCacheControl = "no-cache"
+
 // s3API is the subset of the S3 client this program uses, so tests can fake it.
 type s3API interface {
 	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	PutObject(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	ListObjectsV2(context.Context, *s3.ListObjectsV2Input, ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObjects(context.Context, *s3.DeleteObjectsInput, ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
 }
 
 // splitKey separates the directory from the filename in an S3 object key, e.g.
 // "media/images/tags/bread/orig.jpg" -> "media/images/tags/bread", "orig.jpg".
 //
-// The directory is the identity of the image set; the filename is discarded.
+// The directory is the key template's {prefix}. By default it is also the
+// identity of the image set and the filename is discarded; PER_FILE_OUTPUT and
+// {sourceStem} templates use the filename too.
 func splitKey(s3ObjectKey string) (string, string, error) {
 	if s3ObjectKey == "" {
 		return "", "", errors.New("empty S3 object key")
@@ -51,36 +63,72 @@ func splitKey(s3ObjectKey string) (string, string, error) {
 
 // downloadImage fetches an object and returns its raw bytes.
 func downloadImage(ctx context.Context, client s3API, bucket, key string) ([]byte, error) {
-	response, err := client.GetObject(ctx, &s3.GetObjectInput{
+	data, _, err := downloadObject(ctx, client, bucket, key, "")
+	return data, err
+}
+
+// downloadObject fetches an object's raw bytes and its user metadata. A
+// non-empty versionID fetches that version rather than the current one.
+func downloadObject(ctx context.Context, client s3API, bucket, key, versionID string) ([]byte, map[string]string, error) {
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
-	})
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	response, err := client.GetObject(ctx, input)
 	if err != nil {
-		return nil, fmt.Errorf("getting s3://%s/%s: %w", bucket, key, err)
+		return nil, nil, fmt.Errorf("getting s3://%s/%s: %w", bucket, key, err)
 	}
 	defer response.Body.Close()
 
 	buffer, err := io.ReadAll(response.Body)
 	if err != nil {
-		return nil, fmt.Errorf("reading s3://%s/%s: %w", bucket, key, err)
+		return nil, nil, fmt.Errorf("reading s3://%s/%s: %w", bucket, key, err)
 	}
-	return buffer, nil
+	return buffer, response.Metadata, nil
 }
 
-// uploadDerivatives writes every derivative under the given key prefix.
-func uploadDerivatives(ctx context.Context, client s3API, bucket, prefix string, derivatives []Derivative) error {
-	for _, d := range derivatives {
-		key := d.Filename()
-		if prefix != "" {
-			key = prefix + "/" + key
+// objectKey places a file name under a key prefix. A root-level source has an
+// empty prefix, and its outputs go to the bucket root.
+func objectKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
+// uploadDerivatives writes every derivative to its Key, orig.jpeg and then
+// manifest.json last, so that the manifest only appears once the rest of the
+// set is in place and a reader checking for orig.jpeg never finds it without
+// the sizes. It does not start with less than uploadReserve left, and gives up
+// with an ErrDeadline just before the deadline rather than be killed
+// mid-upload; either way the manifest still describes the previous set.
+// Every file is marked as generated; see guardRecursion.
+func uploadDerivatives(ctx context.Context, client s3API, bucket string, derivatives []Derivative) error {
+	if err := checkDeadline(ctx, uploadReserve); err != nil {
+		return fmt.Errorf("uploading to s3://%s: %w", bucket, err)
+	}
+	uctx, cancel := uploadContext(ctx)
+	defer cancel()
+	for _, d := range uploadOrder(derivatives) {
+		key := d.Key
+		cc := cacheControl
+		if !d.Format.isImage() {
+			cc = metadataCacheControl
 		}
-		_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		_, err := client.PutObject(uctx, &s3.PutObjectInput{
 			Bucket:       aws.String(bucket),
 			Key:          aws.String(key),
 			Body:         bytes.NewReader(d.Data),
 			ContentType:  aws.String(d.ContentType()),
-			CacheControl: aws.String(cacheControl),
+			CacheControl: aws.String(cc),
+			Metadata:     withGeneratedMarker(d.Metadata),
 		})
+		if err != nil && uctx.Err() != nil {
+			return fmt.Errorf("uploading s3://%s/%s: %w: %v", bucket, key, ErrDeadline, err)
+		}
 		if err != nil {
 			return fmt.Errorf("uploading s3://%s/%s: %w", bucket, key, err)
 		}
@@ -88,12 +136,92 @@ func uploadDerivatives(ctx context.Context, client s3API, bucket, prefix string,
 	return nil
 }
 
+// uploadOrder is derivatives in upload order: as given, except that orig.jpeg
+// and then manifest.json go last.
+func uploadOrder(derivatives []Derivative) []Derivative {
+	rank := func(d Derivative) int {
+		switch {
+		case d.Name == manifestName && d.Format == FormatJSON:
+			return 2
+		case d.Name == "orig":
+			return 1
+		}
+		return 0
+	}
+	out := slices.Clone(derivatives)
+	slices.SortStableFunc(out, func(a, b Derivative) int { return rank(a) - rank(b) })
+	return out
+}
+
+// tagOrig attaches S3 user metadata to orig.jpeg, the one object every
+// derivative set is guaranteed to contain.
+func tagOrig(derivatives []Derivative, metadata map[string]string) {
+	for i := range derivatives {
+		if derivatives[i].Name != "orig" {
+			continue
+		}
+		if derivatives[i].Metadata == nil {
+			derivatives[i].Metadata = map[string]string{}
+		}
+		for k, v := range metadata {
+			derivatives[i].Metadata[k] = v
+		}
+	}
+}
+
+// uploadRejection writes rejected.json to the set directory in place of the
+// derivative set. Unlike the derivatives it is not immutable: a later,
+// acceptable upload to the same folder deletes it when its set is published.
+// It carries the source's fingerprint, as manifest.json does; see
+// alreadyRejected.
+func uploadRejection(ctx context.Context, client s3API, bucket, dir string, rej *Rejection, source objectRecord) error {
+	key := objectKey(dir, rejectionReport)
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(rej.JSON()),
+		ContentType:  aws.String("application/json"),
+		CacheControl: aws.String("no-cache"),
+		Metadata:     withGeneratedMarker(sourceMetadata(source)),
+	})
+	if err != nil {
+		return fmt.Errorf("uploading s3://%s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
 // settings holds the run configuration read from the environment.
 type settings struct {
 	destinationBucket string
 	dims              map[string]ImageSize
 	formats           []ImageFormat
 	thumbSize         int
+	limits            decodeLimits
+	rules             acceptRules
+
+	// pictureHTML enables picture.html; its URLs are pictureBaseURL followed
+	// by the object key.
+	pictureHTML    bool
+	pictureBaseURL string
+
+	// keys places each file; see keyTemplate. A template with {hash} also
+	// deletes the previous generation once the new manifest is written.
+	keys keyTemplate
+
+	// force reprocesses a source whose set was already generated from the
+	// same object; see alreadyProcessed.
+	force bool
+
+	// sourceBucket is where HTTP GETs find the source of a file to generate
+	// on demand. Event-driven runs take the bucket from the event.
+	sourceBucket string
+
+	// outputPrefix is where the outputs go when the destination bucket also
+	// receives uploads; see guardRecursion.
+	outputPrefix string
+
+	// filter skips keys that are not photos before anything is downloaded.
+	filter keyFilter
 }
 
 // loadSettings reads configuration from the environment. Empty and unset are
@@ -117,80 +245,361 @@ func loadSettings() (settings, error) {
 		return s, fmt.Errorf("FORMATS: %w", err)
 	}
 
-	s.thumbSize = defaultThumbSize
-	if raw := os.Getenv("THUMB_SIZE"); raw != "" {
-		n, err := strconv.Atoi(raw)
-		if err != nil || n <= 0 {
-			return s, fmt.Errorf("THUMB_SIZE: invalid value %q", raw)
-		}
-		s.thumbSize = n
+	if s.thumbSize, err = envInt("THUMB_SIZE", defaultThumbSize); err != nil {
+		return s, err
+	}
+	if s.limits, err = loadLimits(); err != nil {
+		return s, err
+	}
+	if s.rules, err = loadRules(); err != nil {
+		return s, err
+	}
+	if s.pictureHTML, err = envBool("PICTURE_HTML"); err != nil {
+		return s, err
+	}
+	if s.keys, err = loadKeyTemplate(); err != nil {
+		return s, err
+	}
+	if s.force, err = envBool("FORCE"); err != nil {
+		return s, err
+	}
+	if s.filter, err = loadKeyFilter(); err != nil {
+		return s, err
+	}
+	s.outputPrefix = os.Getenv("OUTPUT_PREFIX")
+	if err := checkOutputPrefix(s.keys, s.outputPrefix); err != nil {
+		return s, err
+	}
+	s.sourceBucket = os.Getenv("SOURCE_BUCKET")
+	s.pictureBaseURL = os.Getenv("PICTURE_BASE_URL")
+	if s.pictureBaseURL == "" {
+		s.pictureBaseURL = "/"
 	}
 	return s, nil
 }
 
-// Handler processes an S3 ObjectCreated event.
-func Handler(ctx context.Context, event events.S3Event) (string, error) {
-	if len(event.Records) == 0 {
-		return "Error", errors.New("event contained no records")
+// envBool reads a boolean in any form strconv.ParseBool accepts, returning
+// false when the variable is unset or empty.
+func envBool(name string) (bool, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return false, nil
 	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid value %q", name, raw)
+	}
+	return v, nil
+}
+
+// envInt reads a positive integer from the environment, returning def when the
+// variable is unset or empty.
+func envInt(name string, def int) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s: invalid value %q", name, raw)
+	}
+	return n, nil
+}
 
+// setup loads the settings and an S3 client for one invocation. Its errors
+// are configuration errors that no retry fixes, so they are logged here.
+func setup(ctx context.Context) (settings, s3API, error) {
 	cfg, err := loadSettings()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
-		return "Error", err
+		return cfg, nil, err
 	}
-
 	awsCfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "AWS configuration error: %v\n", err)
-		return "Error", err
+		return cfg, nil, err
+	}
+	return cfg, s3.NewFromConfig(awsCfg), nil
+}
+
+// recordStatus is what became of one record.
+type recordStatus string
+
+const (
+	statusProcessed recordStatus = "processed"
+	statusSkipped   recordStatus = "skipped"  // already generated from this object
+	statusRejected  recordStatus = "rejected" // refused by the acceptance rules
+	statusFailed    recordStatus = "failed"
+)
+
+// RecordResult is one record's line in a Summary.
+type RecordResult struct {
+	Bucket string       `json:"bucket"`
+	Key    string       `json:"key"`
+	Status recordStatus `json:"status"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// Summary is what Handler returns: one result per record, in event order, and
+// the count of each status.
+type Summary struct {
+	Records   []RecordResult `json:"records"`
+	Processed int            `json:"processed"`
+	Skipped   int            `json:"skipped"`
+	Rejected  int            `json:"rejected"`
+	Failed    int            `json:"failed"`
+}
+
+func (s *Summary) add(r RecordResult) {
+	s.Records = append(s.Records, r)
+	switch r.Status {
+	case statusProcessed:
+		s.Processed++
+	case statusSkipped:
+		s.Skipped++
+	case statusRejected:
+		s.Rejected++
+	default:
+		s.Failed++
 	}
-	client := s3.NewFromConfig(awsCfg)
+}
 
+// Handler processes an S3 ObjectCreated event.
+func Handler(ctx context.Context, event events.S3Event) (Summary, error) {
+	if len(event.Records) == 0 {
+		return Summary{}, errors.New("event contained no records")
+	}
+
+	cfg, client, err := setup(ctx)
+	if err != nil {
+		return Summary{}, err
+	}
+	return handleS3Event(ctx, client, cfg, event)
+}
+
+// handleS3Event attempts every record, so one corrupt upload does not stop
+// the rest of the event. The error joins every failure, each naming its
+// object; a retry of the event redoes only those, as the others are skipped
+// as unchanged.
+func handleS3Event(ctx context.Context, client s3API, cfg settings, event events.S3Event) (Summary, error) {
+	var summary Summary
+	var errs []error
 	for _, record := range event.Records {
-		if err := handleRecord(ctx, client, cfg, record); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			return "Error", err
+		var result RecordResult
+		rec, err := fromS3Record(record)
+		if err != nil {
+			result, err = failedRecord(objectRecord{Bucket: record.S3.Bucket.Name, Key: record.S3.Object.Key}, err)
+		} else {
+			result, err = attemptRecord(ctx, client, cfg, rec)
 		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		summary.add(result)
 	}
-	return "Success", nil
+	fmt.Printf("%d records: %d processed, %d skipped, %d rejected, %d failed\n", len(summary.Records),
+		summary.Processed, summary.Skipped, summary.Rejected, summary.Failed)
+	return summary, errors.Join(errs...)
 }
 
-func handleRecord(ctx context.Context, client s3API, cfg settings, record events.S3EventRecord) error {
-	sourceBucket := record.S3.Bucket.Name
-
-	// S3 URL-encodes object keys in event notifications (a space arrives as
-	// "+"). Without decoding, GetObject 404s on any key containing one.
-	sourceObject, err := url.QueryUnescape(record.S3.Object.Key)
+// attemptRecord processes one record into its summary line. The error, if
+// any, names the object.
+func attemptRecord(ctx context.Context, client s3API, cfg settings, rec objectRecord) (RecordResult, error) {
+	status, err := runRecord(ctx, client, cfg, rec)
 	if err != nil {
-		return fmt.Errorf("decoding object key %q: %w", record.S3.Object.Key, err)
+		return failedRecord(rec, err)
 	}
+	return RecordResult{Bucket: rec.Bucket, Key: rec.Key, Status: status}, nil
+}
+
+func failedRecord(rec objectRecord, err error) (RecordResult, error) {
+	err = fmt.Errorf("s3://%s/%s: %w", rec.Bucket, rec.Key, err)
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	return RecordResult{Bucket: rec.Bucket, Key: rec.Key, Status: statusFailed, Error: err.Error()}, err
+}
+
+// handleRecord processes one created object.
+func handleRecord(ctx context.Context, client s3API, cfg settings, record objectRecord) error {
+	_, err := runRecord(ctx, client, cfg, record)
+	return err
+}
 
+// runRecord processes one created object and reports what became of it.
+func runRecord(ctx context.Context, client s3API, cfg settings, record objectRecord) (recordStatus, error) {
+	sourceBucket, sourceObject := record.Bucket, record.Key
+	// Filtered first, so folder markers and keys outside any folder that the
+	// filter covers are skipped rather than failing in splitKey.
+	if reason := cfg.filter.skip(sourceObject); reason != "" {
+		fmt.Printf("Skipping s3://%s/%s: %s\n", sourceBucket, sourceObject, reason)
+		return statusSkipped, nil
+	}
 	prefix, filename, err := splitKey(sourceObject)
 	if err != nil {
-		return fmt.Errorf("splitting object key %q: %w", sourceObject, err)
+		return statusFailed, fmt.Errorf("splitting object key %q: %w", sourceObject, err)
+	}
+	// A refused record is skipped rather than failed: retrying it, or sending
+	// it to a dead-letter queue, cannot make it safe to process.
+	if output, err := guardRecursion(cfg, record); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: skipping s3://%s/%s: %v\n", sourceBucket, sourceObject, err)
+		return statusSkipped, nil
+	} else if output {
+		fmt.Printf("Ignoring s3://%s/%s: it is under OUTPUT_PREFIX %q\n", sourceBucket, sourceObject, cfg.outputPrefix)
+		return statusSkipped, nil
 	}
 	fmt.Printf("Processing s3://%s/%s (prefix %q, filename %q)\n", sourceBucket, sourceObject, prefix, filename)
+	keys := cfg.keys.withDefault()
+	stem := sourceStem(filename)
+	setDir := keys.setDir(prefix, stem)
+
+	// Redelivered and replayed events are skipped before the download. A
+	// failed check only costs the skip, so it does not fail the record.
+	if !cfg.force {
+		done, err := alreadyProcessed(ctx, client, cfg.destinationBucket, setDir, record)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v; processing anyway\n", err)
+		} else if done {
+			fmt.Printf("Skipping s3://%s/%s: s3://%s/%s was generated from this object (FORCE=true reprocesses)\n",
+				sourceBucket, sourceObject, cfg.destinationBucket, objectKey(setDir, manifestName+".json"))
+			return statusSkipped, nil
+		}
+		// A rejection carries the same fingerprint, and judging the same
+		// bytes again would only reject them again.
+		rejected, err := alreadyRejected(ctx, client, cfg.destinationBucket, setDir, record)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v; processing anyway\n", err)
+		} else if rejected {
+			fmt.Printf("Skipping s3://%s/%s: s3://%s/%s was written for this object (FORCE=true reprocesses)\n",
+				sourceBucket, sourceObject, cfg.destinationBucket, objectKey(setDir, rejectionReport))
+			return statusRejected, nil
+		}
+	}
+
+	// The event carries the object size, so an oversized upload is refused
+	// before paying for the download. decodeImage checks again regardless.
+	if lim := cfg.limits.withDefaults(); record.Size > int64(lim.maxInputBytes) {
+		return statusFailed, fmt.Errorf("decoding %s: %w: %d bytes, limit is %d",
+			sourceObject, ErrTooLarge, record.Size, lim.maxInputBytes)
+	}
 
-	data, err := downloadImage(ctx, client, sourceBucket, sourceObject)
+	data, metadata, err := downloadObject(ctx, client, sourceBucket, sourceObject, record.VersionID)
 	if err != nil {
-		return err
+		return statusFailed, err
 	}
+	// The marker catches outputs that reach us some other way, such as a
+	// second notification or another deployment writing to our source.
+	if metadata[generatedMetadata] != "" {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring s3://%s/%s: it was generated by nnr-photos; check the bucket notifications\n",
+			sourceBucket, sourceObject)
+		return statusSkipped, nil
+	}
+	return publishSource(ctx, client, cfg, record, data)
+}
+
+// decodeError is a source that could not be decoded: corrupt, not an image,
+// or refused by a decode limit.
+type decodeError struct {
+	key string
+	err error
+}
 
-	img, format, err := decodeImage(data)
+func (e *decodeError) Error() string { return fmt.Sprintf("decoding %s: %v", e.key, e.err) }
+func (e *decodeError) Unwrap() error { return e.err }
+
+// publishSource turns the source's bytes into its set and uploads it: the
+// part of runRecord after the download, shared with uploads over HTTP.
+func publishSource(ctx context.Context, client s3API, cfg settings, record objectRecord, data []byte) (recordStatus, error) {
+	sourceBucket, sourceObject := record.Bucket, record.Key
+	prefix, filename, err := splitKey(sourceObject)
 	if err != nil {
-		return fmt.Errorf("decoding %s: %w", sourceObject, err)
+		return statusFailed, fmt.Errorf("splitting object key %q: %w", sourceObject, err)
+	}
+	keys := cfg.keys.withDefault()
+	stem := sourceStem(filename)
+	setDir := keys.setDir(prefix, stem)
+
+	// Decoding cannot be interrupted, so this is the last point at which a
+	// run out of time can stop for free.
+	if err := checkDeadline(ctx, uploadReserve); err != nil {
+		return statusFailed, fmt.Errorf("processing %s: %w", sourceObject, err)
+	}
+	img, format, err := decodeImage(data, cfg.limits)
+	if err != nil {
+		return statusFailed, &decodeError{sourceObject, err}
 	}
 	fmt.Printf("Decoded %s as %s (%dx%d)\n", sourceObject, format, img.Bounds().Dx(), img.Bounds().Dy())
 
-	derivatives, err := processImage(img, cfg.formats, cfg.dims, cfg.thumbSize)
+	if rej := checkAcceptance(img, cfg.rules, sourceObject); rej != nil {
+		releaseImage(img)
+		return statusRejected, rejectRecord(ctx, client, cfg, setDir, rej, record)
+	}
+
+	derivatives, analysis, err := processImage(ctx, img, cfg.formats, cfg.dims, cfg.thumbSize)
+	// The decoded canvas is the largest buffer of the run; hand it back so the
+	// next record on this warm container can reuse it.
+	releaseImage(img)
 	if err != nil {
-		return fmt.Errorf("processing %s: %w", sourceObject, err)
+		return statusFailed, fmt.Errorf("processing %s: %w", sourceObject, err)
+	}
+	q := analysis.Quality
+	fmt.Printf("Quality of %s: sharpness %.2f, brightness %.2f, shadows %.4f, highlights %.4f\n",
+		sourceObject, q.Sharpness, q.Brightness, q.Shadows, q.Highlights)
+	if rej := checkQuality(q, cfg.rules, sourceObject, ImageSize{analysis.Width, analysis.Height}); rej != nil {
+		return statusRejected, rejectRecord(ctx, client, cfg, setDir, rej, record)
+	}
+	tagOrig(derivatives, analysis.metadata())
+	derivatives = append(derivatives, metaDerivative(analysis))
+	assignKeys(derivatives, keys, prefix, stem)
+	if cfg.pictureHTML {
+		pic, err := pictureDerivative(derivatives, func(d Derivative) string {
+			return cfg.pictureBaseURL + d.Key
+		})
+		if err != nil {
+			return statusFailed, fmt.Errorf("building picture.html for %s: %w", sourceObject, err)
+		}
+		derivatives = append(derivatives, pic)
+	}
+	source := ManifestSource{Bucket: sourceBucket, Key: sourceObject, ETag: record.ETag,
+		VersionID: record.VersionID, Format: format}
+	manifest := buildManifest(source, analysis, derivatives).Derivative()
+	manifest.Metadata = sourceMetadata(record)
+	derivatives = append(derivatives, manifest)
+	assignKeys(derivatives, keys, prefix, stem)
+
+	// The previous manifest is the only record of which hashed files belong
+	// to the generation being replaced, so it is read before it is
+	// overwritten. Cleanup is best-effort: the new set is what matters.
+	var previous *Manifest
+	if keys.hashed() {
+		if previous, err = previousManifest(ctx, client, cfg.destinationBucket, setDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: not cleaning up s3://%s/%s: %v\n", cfg.destinationBucket, setDir, err)
+		}
+	}
+
+	if err := uploadDerivatives(ctx, client, cfg.destinationBucket, derivatives); err != nil {
+		return statusFailed, err
 	}
+	fmt.Printf("Uploaded %d derivatives to s3://%s/%s\n", len(derivatives), cfg.destinationBucket, setDir)
+
+	// A report from an earlier, rejected upload would contradict the set
+	// just published, so it goes with the previous generation. Deleting a
+	// missing key succeeds, so it is deleted without checking first.
+	stale := staleFiles(previous, derivatives, setDir)
+	if err := deleteStale(ctx, client, cfg.destinationBucket, append(stale, objectKey(setDir, rejectionReport))); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	} else if len(stale) > 0 {
+		fmt.Printf("Deleted %d files of the previous generation\n", len(stale))
+	}
+	return statusProcessed, nil
+}
 
-	if err := uploadDerivatives(ctx, client, cfg.destinationBucket, prefix, derivatives); err != nil {
+// rejectRecord publishes a rejection report. A rejection is a verdict on the
+// upload, not a failure: retrying cannot change it, so once the report is
+// written the record counts as handled.
+func rejectRecord(ctx context.Context, client s3API, cfg settings, dir string, rej *Rejection, source objectRecord) error {
+	if err := uploadRejection(ctx, client, cfg.destinationBucket, dir, rej, source); err != nil {
 		return err
 	}
-	fmt.Printf("Uploaded %d derivatives to s3://%s/%s\n", len(derivatives), cfg.destinationBucket, prefix)
+	fmt.Printf("Rejected %s: %s; wrote s3://%s/%s\n", rej.Source, rej.Message,
+		cfg.destinationBucket, objectKey(dir, rejectionReport))
 	return nil
 }
@@ -3,14 +3,20 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"image"
 	"image/png"
 	"io"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 func TestSplitKey(t *testing.T) {
@@ -50,6 +56,104 @@ func TestSplitKey(t *testing.T) {
 	}
 }
 
+func TestKeyFilter(t *testing.T) {
+	mustFilter := func(include, exclude, extensions string) keyFilter {
+		t.Helper()
+		var f keyFilter
+		var err error
+		if f.include, err = parseKeyPatterns(include); err != nil {
+			t.Fatal(err)
+		}
+		if f.exclude, err = parseKeyPatterns(exclude); err != nil {
+			t.Fatal(err)
+		}
+		if f.extensions, err = parseExtensions(extensions); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	drafts := mustFilter("", ".DS_Store,*.txt,**/_drafts/**", "")
+	images := mustFilter("", "", "jpg, .JPEG,png,heic")
+	tags := mustFilter("media/images/tags/**", "", "")
+	both := mustFilter("media/**", "**/_drafts/**", "jpg")
+
+	tests := []struct {
+		name   string
+		filter keyFilter
+		key    string
+		want   bool // processed
+	}{
+		{"no filter", keyFilter{}, "anything/at/all", true},
+		{"photo", drafts, "media/images/tags/bread/orig.jpg", true},
+		{"DS_Store at the root", drafts, ".DS_Store", false},
+		{"DS_Store in a folder", drafts, "media/images/tags/.DS_Store", false},
+		{"notes", drafts, "media/images/tags/bread/notes.txt", false},
+		{"drafts folder", drafts, "media/_drafts/bread/orig.jpg", false},
+		{"drafts at the root", drafts, "_drafts/orig.jpg", false},
+		{"drafts lookalike", drafts, "media/my_drafts/orig.jpg", true},
+		{"allowed extension", images, "a/orig.jpg", true},
+		{"extension case", images, "a/IMG_1.JPEG", true},
+		{"other extension", images, "a/orig.gif", false},
+		{"no extension", images, "a/orig", false},
+		{"included", tags, "media/images/tags/bread/orig.jpg", true},
+		{"not included", tags, "media/images/recipes/bread/orig.jpg", false},
+		{"star stays in its segment", mustFilter("media/*/orig.jpg", "", ""), "media/a/b/orig.jpg", false},
+		{"question mark", mustFilter("", "IMG_????.jpg", ""), "a/IMG_0001.jpg", false},
+		{"regexp characters are literal", mustFilter("", "a+b (1).jpg", ""), "x/a+b (1).jpg", false},
+		{"exclude beats include", both, "media/_drafts/orig.jpg", false},
+		{"all three pass", both, "media/tags/orig.jpg", true},
+		{"all three, wrong extension", both, "media/tags/orig.png", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reason := tc.filter.skip(tc.key)
+			if got := reason == ""; got != tc.want {
+				t.Errorf("skip(%q) = %q, want processed %v", tc.key, reason, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadKeyFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name, include, exclude, extensions string
+		wantErr                            string
+	}{
+		{"unset", "", "", "", ""},
+		{"lists with spaces", "media/**, uploads/**", " *.txt ,", "jpg, png", ""},
+		{"empty extension list", "", "", ",", "ALLOWED_EXTENSIONS"},
+		{"extension with a dot inside", "", "", "tar.gz", "ALLOWED_EXTENSIONS"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("INCLUDE_PATTERNS", tc.include)
+			t.Setenv("EXCLUDE_PATTERNS", tc.exclude)
+			t.Setenv("ALLOWED_EXTENSIONS", tc.extensions)
+			_, err := loadKeyFilter()
+			if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("loadKeyFilter() = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestHandleRecordSkipsFilteredKeys: a filtered key is not even downloaded,
+// nor failed for a shape splitKey refuses.
+func TestHandleRecordSkipsFilteredKeys(t *testing.T) {
+	fake := &fakeS3{getErr: errors.New("downloaded")}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64}
+	var err error
+	if cfg.filter.exclude, err = parseKeyPatterns(".DS_Store,*.txt,**/_drafts/**"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"tags/bread/.DS_Store", "notes.txt", "_drafts/"} {
+		status, err := runRecord(context.Background(), fake, cfg, objectRecord{Bucket: "src", Key: key})
+		if err != nil || status != statusSkipped {
+			t.Errorf("runRecord(%q) = %s, %v, want skipped", key, status, err)
+		}
+	}
+}
+
 // TestSplitKeyNoPanic is an explicit regression guard: any key at all must
 // return, never panic.
 func TestSplitKeyNoPanic(t *testing.T) {
@@ -65,19 +169,104 @@ func TestSplitKeyNoPanic(t *testing.T) {
 	}
 }
 
+// handleS3Record processes one record of a classic S3 notification, the way
+// most of these tests drive the handler.
+func handleS3Record(ctx context.Context, client s3API, cfg settings, record events.S3EventRecord) error {
+	rec, err := fromS3Record(record)
+	if err != nil {
+		return err
+	}
+	return handleRecord(ctx, client, cfg, rec)
+}
+
 // fakeS3 records what was uploaded so the handler can be tested end to end.
+// GetObject returns object for any key unless objects is set, in which case
+// it serves and lists those. HeadObject answers from what was put, then
+// from objects.
 type fakeS3 struct {
-	object []byte
-	getErr error
-	puts   []*s3.PutObjectInput
-	bodies map[string][]byte
+	object   []byte
+	objects  map[string][]byte
+	getErr   error
+	getErrs  map[string]error // per key
+	headErr  error
+	puts     []*s3.PutObjectInput
+	bodies   map[string][]byte
+	deleted  []string
+	versions []string // the VersionId of every Get and Head that named one
 }
 
 func (f *fakeS3) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if in.VersionId != nil {
+		f.versions = append(f.versions, "get "+*in.VersionId)
+	}
 	if f.getErr != nil {
 		return nil, f.getErr
 	}
-	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(f.object))}, nil
+	if err := f.getErrs[*in.Key]; err != nil {
+		return nil, err
+	}
+	body := f.object
+	if f.objects != nil {
+		var ok bool
+		if body, ok = f.objects[*in.Key]; !ok {
+			// What was put can be read back, as from the destination bucket.
+			for i := len(f.puts) - 1; i >= 0; i-- {
+				if p := f.puts[i]; *p.Key == *in.Key {
+					return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(f.bodies[*in.Key])),
+						ContentType: p.ContentType, CacheControl: p.CacheControl, Metadata: p.Metadata}, nil
+				}
+			}
+			return nil, &types.NoSuchKey{Message: in.Key}
+		}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func (f *fakeS3) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if in.VersionId != nil {
+		f.versions = append(f.versions, "head "+*in.VersionId)
+	}
+	if f.headErr != nil {
+		return nil, f.headErr
+	}
+	for i := len(f.puts) - 1; i >= 0; i-- {
+		if *f.puts[i].Key == *in.Key {
+			return &s3.HeadObjectOutput{Metadata: f.puts[i].Metadata}, nil
+		}
+	}
+	if body, ok := f.objects[*in.Key]; ok {
+		return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(body))), ETag: aws.String(`"etag-` + *in.Key + `"`)}, nil
+	}
+	return nil, &types.NotFound{}
+}
+
+func (f *fakeS3) DeleteObjects(_ context.Context, in *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	for _, o := range in.Delete.Objects {
+		f.deleted = append(f.deleted, *o.Key)
+		delete(f.objects, *o.Key)
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+// ListObjectsV2 pages through objects in key order, two keys per page so
+// callers' pagination is exercised.
+func (f *fakeS3) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, aws.ToString(in.Prefix)) && k > aws.ToString(in.ContinuationToken) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(len(keys) > 2)}
+	if len(keys) > 2 {
+		keys = keys[:2]
+		out.NextContinuationToken = aws.String(keys[1])
+	}
+	for _, k := range keys {
+		out.Contents = append(out.Contents, types.Object{Key: aws.String(k)})
+	}
+	return out, nil
 }
 
 func (f *fakeS3) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
@@ -120,14 +309,16 @@ func TestHandleRecordUploadsEverything(t *testing.T) {
 	rec.S3.Bucket.Name = "src"
 	rec.S3.Object.Key = "media/images/tags/bread/orig.png"
 
-	if err := handleRecord(context.Background(), fake, cfg, rec); err != nil {
+	if err := handleS3Record(context.Background(), fake, cfg, rec); err != nil {
 		t.Fatal(err)
 	}
 
-	if len(fake.puts) != 14 {
-		t.Errorf("uploaded %d objects, want 14", len(fake.puts))
+	// 12 breakpoint images, orig, thumbnail, meta.json and manifest.json.
+	if len(fake.puts) != 16 {
+		t.Errorf("uploaded %d objects, want 16", len(fake.puts))
 	}
 	want := map[string]string{
+		"media/images/tags/bread/meta.json":      "application/json",
 		"media/images/tags/bread/orig.jpeg":      "image/jpeg",
 		"media/images/tags/bread/thumbnail.jpeg": "image/jpeg",
 		"media/images/tags/bread/1200.jpeg":      "image/jpeg",
@@ -146,6 +337,11 @@ func TestHandleRecordUploadsEverything(t *testing.T) {
 			t.Errorf("key %s: ContentType %q, want %q", key, got[key], ct)
 		}
 	}
+	for _, p := range fake.puts {
+		if *p.Key == "media/images/tags/bread/orig.jpeg" && p.Metadata["nnr-sharpness"] == "" {
+			t.Errorf("orig.jpeg has no quality metadata: %v", p.Metadata)
+		}
+	}
 }
 
 // TestHandleRecordDecodesURLEncodedKey covers keys with spaces, which S3
@@ -163,7 +359,7 @@ func TestHandleRecordDecodesURLEncodedKey(t *testing.T) {
 	// S3 escapes within path segments and leaves the slashes alone.
 	rec.S3.Object.Key = "media/images/tags/my+bread/orig.png"
 
-	if err := handleRecord(context.Background(), fake, cfg, rec); err != nil {
+	if err := handleS3Record(context.Background(), fake, cfg, rec); err != nil {
 		t.Fatal(err)
 	}
 	for _, p := range fake.puts {
@@ -184,7 +380,7 @@ func TestHandleRecordPropagatesDownloadError(t *testing.T) {
 	cfg := settings{destinationBucket: "dest", dims: getDefaultDims(), formats: getDefaultImageTypes(), thumbSize: 128}
 	rec := events.S3EventRecord{}
 	rec.S3.Object.Key = "a/b.png"
-	if err := handleRecord(context.Background(), fake, cfg, rec); err == nil {
+	if err := handleS3Record(context.Background(), fake, cfg, rec); err == nil {
 		t.Error("expected download error to propagate")
 	}
 }
@@ -195,10 +391,205 @@ func TestHandleRecordRejectsNonImage(t *testing.T) {
 	cfg := settings{destinationBucket: "dest", dims: getDefaultDims(), formats: getDefaultImageTypes(), thumbSize: 128}
 	rec := events.S3EventRecord{}
 	rec.S3.Object.Key = "a/b.txt"
-	if err := handleRecord(context.Background(), fake, cfg, rec); err == nil {
+	if err := handleS3Record(context.Background(), fake, cfg, rec); err == nil {
 		t.Error("expected a non-image to fail")
 	}
 	if len(fake.puts) != 0 {
 		t.Errorf("uploaded %d objects for a non-image, want 0", len(fake.puts))
 	}
 }
+
+// TestHandleRecordRejectsUndersized: an image below the minimums publishes a
+// report instead of derivatives, and is not an error (retrying cannot help).
+func TestHandleRecordRejectsUndersized(t *testing.T) {
+	fake := &fakeS3{object: testPNG(t, 200, 150)}
+	cfg := settings{
+		destinationBucket: "dest",
+		dims:              getDefaultDims(),
+		formats:           getDefaultImageTypes(),
+		thumbSize:         defaultThumbSize,
+		rules:             acceptRules{minWidth: 800, minHeight: 600},
+	}
+	rec := events.S3EventRecord{}
+	rec.S3.Bucket.Name = "src"
+	rec.S3.Object.Key = "media/images/tags/bread/orig.png"
+
+	if err := handleS3Record(context.Background(), fake, cfg, rec); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.puts) != 1 || *fake.puts[0].Key != "media/images/tags/bread/rejected.json" {
+		var keys []string
+		for _, p := range fake.puts {
+			keys = append(keys, *p.Key)
+		}
+		t.Fatalf("uploaded %v, want only the rejection report", keys)
+	}
+	if ct := *fake.puts[0].ContentType; ct != "application/json" {
+		t.Errorf("ContentType %q, want application/json", ct)
+	}
+	if !bytes.Contains(fake.bodies["media/images/tags/bread/rejected.json"], []byte(`"too_small"`)) {
+		t.Errorf("report does not give the reason: %s", fake.bodies["media/images/tags/bread/rejected.json"])
+	}
+}
+
+// TestHandleRecordRejectsBlurry: the quality gate runs after processing, and a
+// failing image must still publish nothing but the report.
+func TestHandleRecordRejectsBlurry(t *testing.T) {
+	fake := &fakeS3{object: testPNG(t, 800, 600)}
+	cfg := settings{
+		destinationBucket: "dest",
+		dims:              getDefaultDims(),
+		formats:           getDefaultImageTypes(),
+		thumbSize:         defaultThumbSize,
+		rules:             acceptRules{minSharpness: 1e9},
+	}
+	rec := events.S3EventRecord{}
+	rec.S3.Object.Key = "a/b.png"
+	if err := handleS3Record(context.Background(), fake, cfg, rec); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.puts) != 1 || *fake.puts[0].Key != "a/rejected.json" {
+		t.Fatalf("uploaded %d objects, want only a/rejected.json", len(fake.puts))
+	}
+	if !bytes.Contains(fake.bodies["a/rejected.json"], []byte(`"blurry"`)) {
+		t.Errorf("report does not give the reason: %s", fake.bodies["a/rejected.json"])
+	}
+}
+
+// TestHandleRecordClearsRejection: an accepted upload to a folder deletes the
+// report left by an earlier, rejected one, and a rejection deletes nothing.
+func TestHandleRecordClearsRejection(t *testing.T) {
+	fake := &fakeS3{object: testPNG(t, 200, 150)}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64, rules: acceptRules{minWidth: 400}}
+	rec := objectRecord{Bucket: "src", Key: "a/b.png"}
+	if status, err := runRecord(context.Background(), fake, cfg, rec); err != nil || status != statusRejected {
+		t.Fatalf("small upload: %s, %v, want rejected", status, err)
+	}
+	if len(fake.deleted) != 0 {
+		t.Fatalf("rejection deleted %v", fake.deleted)
+	}
+	fake.object = testPNG(t, 800, 600)
+	if status, err := runRecord(context.Background(), fake, cfg, rec); err != nil || status != statusProcessed {
+		t.Fatalf("large upload: %s, %v, want processed", status, err)
+	}
+	if want := []string{"a/rejected.json"}; !reflect.DeepEqual(fake.deleted, want) {
+		t.Errorf("deleted %v, want %v", fake.deleted, want)
+	}
+}
+
+// TestHandleRecordWritesManifestLast: manifest.json must be the final upload,
+// so its presence means the set is complete, and it must list every other file.
+func TestHandleRecordWritesManifestLast(t *testing.T) {
+	fake := &fakeS3{object: testPNG(t, 800, 600)}
+	cfg := settings{destinationBucket: "dest", dims: getDefaultDims(), formats: getDefaultImageTypes(), thumbSize: 128}
+	rec := events.S3EventRecord{}
+	rec.S3.Bucket.Name = "src"
+	rec.S3.Object.Key = "a/b.png"
+	rec.S3.Object.ETag = "0123456789abcdef"
+	if err := handleS3Record(context.Background(), fake, cfg, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	last := fake.puts[len(fake.puts)-1]
+	if *last.Key != "a/manifest.json" {
+		t.Fatalf("last upload is %s, want a/manifest.json", *last.Key)
+	}
+	if *last.CacheControl != metadataCacheControl {
+		t.Errorf("manifest Cache-Control %q, want %q", *last.CacheControl, metadataCacheControl)
+	}
+	var m Manifest
+	if err := json.Unmarshal(fake.bodies["a/manifest.json"], &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Source.Bucket != "src" || m.Source.Key != "a/b.png" || m.Source.ETag != "0123456789abcdef" || m.Source.Format != "png" {
+		t.Errorf("source %+v", m.Source)
+	}
+	if len(m.Derivatives) != len(fake.puts)-1 {
+		t.Errorf("manifest lists %d files, %d others were uploaded", len(m.Derivatives), len(fake.puts)-1)
+	}
+	for _, e := range m.Derivatives {
+		if _, ok := fake.bodies["a/"+e.Filename]; !ok {
+			t.Errorf("manifest lists %s, which was not uploaded", e.Filename)
+		}
+	}
+}
+
+func TestHandleRecordWritesPictureHTML(t *testing.T) {
+	fake := &fakeS3{object: testPNG(t, 800, 600)}
+	cfg := settings{destinationBucket: "dest", dims: getDefaultDims(), formats: getDefaultImageTypes(), thumbSize: 128,
+		pictureHTML: true, pictureBaseURL: "https://cdn.example.com/"}
+	rec := events.S3EventRecord{}
+	rec.S3.Bucket.Name = "src"
+	rec.S3.Object.Key = "a/b.png"
+	if err := handleS3Record(context.Background(), fake, cfg, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	body, ok := fake.bodies["a/picture.html"]
+	if !ok {
+		t.Fatal("picture.html was not uploaded")
+	}
+	if !bytes.Contains(body, []byte(`src="https://cdn.example.com/a/1200.jpeg"`)) {
+		t.Errorf("URLs are not built from PICTURE_BASE_URL and the key:\n%s", body)
+	}
+	for _, p := range fake.puts {
+		if *p.Key == "a/picture.html" && (*p.ContentType != "text/html; charset=utf-8" || *p.CacheControl != metadataCacheControl) {
+			t.Errorf("picture.html uploaded as %s, %s", *p.ContentType, *p.CacheControl)
+		}
+	}
+	if last := fake.puts[len(fake.puts)-1]; *last.Key != "a/manifest.json" {
+		t.Errorf("last upload is %s, want a/manifest.json", *last.Key)
+	}
+}
+
+// TestHandleS3EventAttemptsEveryRecord: a corrupt upload early in the event
+// neither stops the records after it nor hides which objects failed.
+func TestHandleS3EventAttemptsEveryRecord(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{
+		"tags/soup/orig.jpg":  []byte("garbage"),
+		"tags/bread/orig.png": testPNG(t, 800, 600),
+		"tags/tiny/orig.png":  testPNG(t, 200, 150),
+		"tags/cake/orig.png":  testPNG(t, 800, 600),
+	}}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64, rules: acceptRules{minWidth: 400}}
+	var event events.S3Event
+	for _, key := range []string{"tags/soup/orig.jpg", "tags/bread/orig.png", "tags/tiny/orig.png",
+		"tags/pie/orig.png", "tags/cake/orig.png", "tags/bad%zzkey.png"} {
+		rec := events.S3EventRecord{EventSource: "aws:s3"}
+		rec.S3.Bucket.Name = "src"
+		rec.S3.Object.Key = key
+		event.Records = append(event.Records, rec)
+	}
+
+	summary, err := handleS3Event(context.Background(), fake, cfg, event)
+	if err == nil {
+		t.Fatal("want an error for the failed records")
+	}
+	for _, key := range []string{"s3://src/tags/soup/orig.jpg", "s3://src/tags/pie/orig.png", "s3://src/tags/bad%zzkey.png"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q does not name %s", err, key)
+		}
+	}
+
+	var got []recordStatus
+	for _, r := range summary.Records {
+		got = append(got, r.Status)
+		if (r.Status == statusFailed) != (r.Error != "") {
+			t.Errorf("%s: status %s with error %q", r.Key, r.Status, r.Error)
+		}
+	}
+	want := []recordStatus{statusFailed, statusProcessed, statusRejected, statusFailed, statusProcessed, statusFailed}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	if summary.Processed != 2 || summary.Rejected != 1 || summary.Failed != 3 || summary.Skipped != 0 {
+		t.Errorf("counts = %+v", summary)
+	}
+	for _, key := range []string{"tags/bread/manifest.json", "tags/cake/manifest.json", "tags/tiny/" + rejectionReport} {
+		if fake.bodies[key] == nil {
+			t.Errorf("%s was not uploaded", key)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// contentHashLength is how many hex digits of the SHA-256 go into a hashed
+// file name. 24 bits only has to tell one generation of a file from the next.
+const contentHashLength = 6
+
+// hashFilenames switches every image derivative to a content-hashed name,
+// "1200.webp" -> "1200.3fa2c1.webp", so a replaced photo gets new URLs and the
+// year-long immutable Cache-Control is actually true. meta.json, picture.html
+// and manifest.json keep their plain names: they are the fixed entry points
+// that say which hashed files are current, and are served no-cache.
+//
+// The command line uses it directly; the Lambda gets the same names from
+// hashedKeyTemplate. It must run after the image bytes are final and before
+// anything that records file names (picture.html, the manifest).
+func hashFilenames(derivatives []Derivative) {
+	for i := range derivatives {
+		if !derivatives[i].Format.isImage() {
+			continue
+		}
+		sum := sha256.Sum256(derivatives[i].Data)
+		derivatives[i].Hash = hex.EncodeToString(sum[:])[:contentHashLength]
+	}
+}
+
+// staleFiles lists the keys of a previous generation that the new set does
+// not overwrite. A nil previous manifest has none. Entries without a key
+// (manifests written before KEY_TEMPLATE, or on the command line) are taken
+// to be in dir, the set directory.
+func staleFiles(previous *Manifest, current []Derivative, dir string) []string {
+	if previous == nil {
+		return nil
+	}
+	keep := make(map[string]bool, len(current))
+	for _, d := range current {
+		if d.Key != "" {
+			keep[d.Key] = true
+		} else {
+			keep[objectKey(dir, d.Filename())] = true
+		}
+	}
+	var stale []string
+	for _, e := range previous.Derivatives {
+		key := e.Key
+		if key == "" {
+			key = objectKey(dir, e.Filename)
+		}
+		if !keep[key] {
+			stale = append(stale, key)
+		}
+	}
+	return stale
+}
+
+// previousManifest reads the manifest a set directory currently has, or
+// returns nil if it has none.
+func previousManifest(ctx context.Context, client s3API, bucket, dir string) (*Manifest, error) {
+	data, err := downloadImage(ctx, client, bucket, objectKey(dir, manifestName+".json"))
+	var missing *types.NoSuchKey
+	if errors.As(err, &missing) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+// parseManifest reads a manifest.json.
+func parseManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// deleteStale removes a previous generation's leftover files. It runs only
+// after the new manifest is written, so a page never points at a deleted
+// file that has no replacement yet.
+func deleteStale(ctx context.Context, client s3API, bucket string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	objects := make([]types.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+	}
+	out, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		return fmt.Errorf("deleting the previous generation from s3://%s: %w", bucket, err)
+	}
+	if len(out.Errors) > 0 {
+		e := out.Errors[0]
+		return fmt.Errorf("deleting s3://%s/%s: %s (%d of %d failed)",
+			bucket, aws.ToString(e.Key), aws.ToString(e.Message), len(out.Errors), len(keys))
+	}
+	return nil
+}
+
+// localPreviousManifest is previousManifest for the command line.
+func localPreviousManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHashFilenames(t *testing.T) {
+	ds := []Derivative{
+		{Name: "1200", Format: FormatWEBP, Data: []byte("one")},
+		{Name: "1200", Format: FormatJPEG, Data: []byte("one")},
+		{Name: "992", Format: FormatWEBP, Data: []byte("two")},
+		{Name: "meta", Format: FormatJSON, Data: []byte("{}")},
+		{Name: "picture", Format: FormatHTML, Data: []byte("<picture>")},
+	}
+	hashFilenames(ds)
+
+	hashed := regexp.MustCompile(`^[a-z0-9]+\.[0-9a-f]{6}\.(webp|jpeg)$`)
+	for _, d := range ds[:3] {
+		if !hashed.MatchString(d.Filename()) {
+			t.Errorf("%s is not content-hashed", d.Filename())
+		}
+	}
+	if ds[0].Hash != ds[1].Hash || ds[0].Hash == ds[2].Hash {
+		t.Errorf("hashes %q %q %q do not follow the content", ds[0].Hash, ds[1].Hash, ds[2].Hash)
+	}
+	if ds[0].Filename() == ds[1].Filename() {
+		t.Error("the format no longer distinguishes two files with equal bytes")
+	}
+	if ds[3].Filename() != "meta.json" || ds[4].Filename() != "picture.html" {
+		t.Errorf("entry points were renamed: %s, %s", ds[3].Filename(), ds[4].Filename())
+	}
+}
+
+func TestStaleFiles(t *testing.T) {
+	current := []Derivative{
+		{Name: "1200", Format: FormatWEBP, Hash: "bbbbbb"},
+		{Name: "meta", Format: FormatJSON},
+	}
+	for _, tc := range []struct {
+		name     string
+		previous *Manifest
+		want     []string
+	}{
+		{"first upload", nil, nil},
+		{"same set", &Manifest{Derivatives: []ManifestEntry{{Filename: "1200.bbbbbb.webp"}, {Filename: "meta.json"}}}, nil},
+		{"replaced", &Manifest{Derivatives: []ManifestEntry{{Filename: "1200.aaaaaa.webp"}, {Filename: "meta.json"}}}, []string{"1200.aaaaaa.webp"}},
+		{"from plain names", &Manifest{Derivatives: []ManifestEntry{{Filename: "1200.webp"}, {Filename: "320.webp"}}}, []string{"1200.webp", "320.webp"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := staleFiles(tc.previous, current, ""); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestHandleRecordHashedKeysReplacesGeneration: replacing a photo publishes a
+// new set of hashed names, then deletes exactly the files of the old one.
+func TestHandleRecordHashedKeysReplacesGeneration(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{"a/b.png": testPNG(t, 800, 600)}}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64, keys: mustKeyTemplate(t, hashedKeyTemplate), pictureHTML: true, pictureBaseURL: "/"}
+	rec := events.S3EventRecord{}
+	rec.S3.Bucket.Name = "src"
+	rec.S3.Object.Key = "a/b.png"
+
+	if err := handleS3Record(context.Background(), fake, cfg, rec); err != nil {
+		t.Fatal(err)
+	}
+	// Only the rejection report, which is always cleared and is not there.
+	if want := []string{"a/rejected.json"}; !reflect.DeepEqual(fake.deleted, want) {
+		t.Fatalf("the first upload deleted %v, want %v", fake.deleted, want)
+	}
+	first := map[string]bool{}
+	for key := range fake.bodies {
+		first[key] = true
+	}
+	if !first["a/manifest.json"] || !first["a/meta.json"] || first["a/400.webp"] {
+		t.Fatalf("unexpected keys %v", first)
+	}
+
+	// The manifest is what the next run reads; the photo is replaced.
+	fake.objects["a/manifest.json"] = fake.bodies["a/manifest.json"]
+	fake.objects["a/b.png"] = testPNG(t, 900, 600)
+	fake.bodies, fake.puts = nil, nil
+	if err := handleS3Record(context.Background(), fake, cfg, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	var wantDeleted []string
+	for key := range first {
+		if _, rewritten := fake.bodies[key]; !rewritten {
+			wantDeleted = append(wantDeleted, key)
+		}
+	}
+	// orig, thumbnail and 400 in two formats; all four changed.
+	if len(wantDeleted) != 4 {
+		t.Errorf("%d old files were not rewritten, want 4: %v", len(wantDeleted), wantDeleted)
+	}
+	gotDeleted := map[string]bool{}
+	for _, k := range fake.deleted {
+		gotDeleted[k] = true
+	}
+	for _, k := range wantDeleted {
+		if !gotDeleted[k] {
+			t.Errorf("%s of the old generation was not deleted", k)
+		}
+	}
+	for _, k := range fake.deleted {
+		if _, rewritten := fake.bodies[k]; rewritten {
+			t.Errorf("deleted %s, which belongs to the new set", k)
+		}
+	}
+	if !regexp.MustCompile(`src="/a/400\.[0-9a-f]{6}\.jpeg"`).Match(fake.bodies["a/picture.html"]) {
+		t.Errorf("picture.html does not use the hashed names:\n%s", fake.bodies["a/picture.html"])
+	}
+}
+
+// TestHandleRecordTwoPhotosOneFolder: with a folder per source, publishing
+// one photo neither reads, overwrites nor deletes its neighbour's set.
+func TestHandleRecordTwoPhotosOneFolder(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{
+		"tags/a.png": testPNG(t, 800, 600),
+		"tags/b.png": testPNG(t, 900, 600),
+	}}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64, keys: mustKeyTemplate(t, perFileHashedKeyTemplate)}
+	for _, key := range []string{"tags/a.png", "tags/b.png"} {
+		if _, err := runRecord(context.Background(), fake, cfg, objectRecord{Bucket: "src", Key: key}); err != nil {
+			t.Fatal(err)
+		}
+		// As on S3, the next run reads back what this one published.
+		for k, body := range fake.bodies {
+			fake.objects[k] = body
+		}
+	}
+	for _, k := range fake.deleted {
+		if !strings.HasSuffix(k, "/"+rejectionReport) {
+			t.Errorf("deleted %s", k)
+		}
+	}
+	for _, k := range []string{"tags/a/manifest.json", "tags/b/manifest.json"} {
+		m, err := parseManifest(fake.bodies[k])
+		if err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+		if want := "tags/" + path.Base(path.Dir(k)) + ".png"; m.Source.Key != want {
+			t.Errorf("%s describes %s, want %s", k, m.Source.Key, want)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxResponseBytes keeps a served file under the 6 MB response limit of
+// function URLs and HTTP APIs once base64 has grown it by a third.
+const maxResponseBytes = 4 << 20
+
+// httpSourceRequest is the JSON body of a POST naming a source in S3 rather
+// than carrying the image.
+type httpSourceRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// HTTPHandler answers Lambda function URL and API Gateway HTTP API requests,
+// which share the 2.0 payload format:
+//
+//   - POST with an image body and ?key=<source key> processes the body as if
+//     it had been uploaded to that key and returns the manifest.
+//   - POST with a JSON body {"bucket": ..., "key": ...} processes that source
+//     object and returns the manifest.
+//   - GET /{key} serves a file of a set, generating the set from SOURCE_BUCKET
+//     first if the file does not exist yet.
+//
+// A rejected source is answered 422 with its rejection report.
+func HTTPHandler(ctx context.Context, req events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	cfg, client, err := setup(ctx)
+	if err != nil {
+		return httpError(http.StatusInternalServerError, err), nil
+	}
+	return handleHTTP(ctx, client, cfg, req), nil
+}
+
+func handleHTTP(ctx context.Context, client s3API, cfg settings, req events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+	method := req.RequestContext.HTTP.Method
+	fmt.Printf("HTTP %s %s\n", method, req.RawPath)
+	switch method {
+	case http.MethodPost:
+		if isJSON(req.Headers) {
+			return postSource(ctx, client, cfg, req)
+		}
+		return postImage(ctx, client, cfg, req)
+	case http.MethodGet:
+		return getFile(ctx, client, cfg, req)
+	}
+	resp := httpError(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", method))
+	resp.Headers["Allow"] = "GET, POST"
+	return resp
+}
+
+// isJSON reports whether the request body is JSON. Function URLs lowercase
+// header names; API Gateway passes them as sent.
+func isJSON(headers map[string]string) bool {
+	for name, value := range headers {
+		if strings.EqualFold(name, "Content-Type") {
+			return strings.HasPrefix(strings.ToLower(value), "application/json")
+		}
+	}
+	return false
+}
+
+// postImage processes the request body, the way the dev server used to run
+// the binary on each upload. Nothing is written to the source bucket: the
+// key only places the set.
+func postImage(ctx context.Context, client s3API, cfg settings, req events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+	key := req.QueryStringParameters["key"]
+	if key == "" {
+		return httpError(http.StatusBadRequest, errors.New("an image upload needs a ?key= to place its set"))
+	}
+	// The key decides where the set is written, so it gets the same filter as
+	// an upload to the source bucket would.
+	if reason := cfg.filter.skip(key); reason != "" {
+		return httpError(http.StatusForbidden, fmt.Errorf("%s: %s", key, reason))
+	}
+	data := []byte(req.Body)
+	if req.IsBase64Encoded {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(req.Body); err != nil {
+			return httpError(http.StatusBadRequest, fmt.Errorf("decoding the base64 body: %w", err))
+		}
+	}
+	if len(data) == 0 {
+		return httpError(http.StatusBadRequest, errors.New("empty body"))
+	}
+	rec := objectRecord{Key: key, Size: int64(len(data))}
+	if lim := cfg.limits.withDefaults(); rec.Size > int64(lim.maxInputBytes) {
+		return httpError(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("%w: %d bytes, limit is %d", ErrTooLarge, rec.Size, lim.maxInputBytes))
+	}
+	status, err := publishSource(ctx, client, cfg, rec, data)
+	return setResponse(ctx, client, cfg, key, status, err)
+}
+
+// postSource processes a source already in S3. An unchanged source is
+// skipped as usual and answered with its existing manifest. Only
+// SOURCE_BUCKET is read, so a caller cannot have the function's role fetch
+// another bucket's objects and write sets made from them.
+func postSource(ctx context.Context, client s3API, cfg settings, req events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+	var body httpSourceRequest
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		return httpError(http.StatusBadRequest, fmt.Errorf("reading the request: %w", err))
+	}
+	if body.Bucket == "" || body.Key == "" {
+		return httpError(http.StatusBadRequest, errors.New("the request needs a bucket and a key"))
+	}
+	if cfg.sourceBucket == "" || body.Bucket != cfg.sourceBucket {
+		return httpError(http.StatusForbidden, fmt.Errorf("bucket %q is not SOURCE_BUCKET", body.Bucket))
+	}
+	if reason := cfg.filter.skip(body.Key); reason != "" {
+		return httpError(http.StatusForbidden, fmt.Errorf("%s: %s", body.Key, reason))
+	}
+	rec, err := headSource(ctx, client, body.Bucket, body.Key, "")
+	if err != nil {
+		return httpError(errorStatus(err), err)
+	}
+	status, err := runRecord(ctx, client, cfg, rec)
+	return setResponse(ctx, client, cfg, body.Key, status, err)
+}
+
+// setResponse answers a processed source with its manifest, or its rejection
+// report. Both are read back from the destination bucket, which also covers
+// a skipped source.
+func setResponse(ctx context.Context, client s3API, cfg settings, key string, status recordStatus, err error) events.LambdaFunctionURLResponse {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", key, err)
+		return httpError(errorStatus(err), err)
+	}
+	prefix, filename, err := splitKey(key)
+	if err != nil {
+		return httpError(http.StatusBadRequest, err)
+	}
+	dir := cfg.keys.withDefault().setDir(prefix, sourceStem(filename))
+	name, code := manifestName+".json", http.StatusOK
+	if status == statusRejected {
+		name, code = rejectionReport, http.StatusUnprocessableEntity
+	}
+	data, err := downloadImage(ctx, client, cfg.destinationBucket, objectKey(dir, name))
+	if err != nil {
+		return httpError(errorStatus(err), err)
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: code,
+		Headers:    map[string]string{"Content-Type": "application/json", "Cache-Control": metadataCacheControl},
+		Body:       string(data),
+	}
+}
+
+// getFile serves a file of a set. A missing one is generated on demand when
+// the path is one the key template produces, names a configured size and
+// format, and leads back to exactly one source image in SOURCE_BUCKET whose
+// set has not been generated yet.
+func getFile(ctx context.Context, client s3API, cfg settings, req events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+	key, err := url.PathUnescape(strings.TrimPrefix(req.RawPath, "/"))
+	if err != nil || key == "" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("bad path %q", req.RawPath))
+	}
+	if resp, ok := serveObject(ctx, client, cfg.destinationBucket, key); ok {
+		return resp
+	}
+	vars, ok := cfg.keys.withDefault().parse(key)
+	ext := vars["ext"]
+	if ext == "" {
+		ext = vars["format"]
+	}
+	if !ok || vars["prefix"] == "" || !cfg.generates(vars["name"], ext) {
+		return httpError(http.StatusNotFound, fmt.Errorf("%s is not a file this function generates", key))
+	}
+	if cfg.sourceBucket == "" {
+		return httpError(http.StatusNotFound, errors.New("on-demand generation needs SOURCE_BUCKET"))
+	}
+	source, err := findSource(ctx, client, cfg.sourceBucket, vars["prefix"], vars["sourceStem"])
+	if err != nil {
+		return httpError(errorStatus(err), err)
+	}
+	rec, err := headSource(ctx, client, cfg.sourceBucket, source, "")
+	if err != nil {
+		return httpError(errorStatus(err), err)
+	}
+	// Anyone can ask for any name, so only a source with no current set is
+	// processed: runRecord skips one whose set or rejection was written for
+	// this very object, which has all the files it will ever have.
+	status, err := runRecord(ctx, client, cfg, rec)
+	if err != nil || status == statusRejected {
+		return setResponse(ctx, client, cfg, source, status, err)
+	}
+	if status == statusProcessed {
+		if resp, ok := serveObject(ctx, client, cfg.destinationBucket, key); ok {
+			return resp
+		}
+	}
+	return httpError(http.StatusNotFound, fmt.Errorf("%s is not part of the set of %s", key, source))
+}
+
+// generates reports whether a set contains a file with this name and
+// extension: a configured size in a configured format, or the JPEG original
+// and thumbnail.
+func (cfg settings) generates(name, ext string) bool {
+	if name == "orig" || name == "thumbnail" {
+		return ext == "" || ext == "jpeg"
+	}
+	if _, ok := cfg.dims[name]; !ok {
+		return false
+	}
+	if ext == "" {
+		return true
+	}
+	for _, f := range cfg.formats {
+		if f.String() == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// serveObject answers with an object's bytes. It reports false when the
+// object does not exist; any other error is answered.
+func serveObject(ctx context.Context, client s3API, bucket, key string) (events.LambdaFunctionURLResponse, bool) {
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	var noKey *types.NoSuchKey
+	if errors.As(err, &noKey) {
+		return events.LambdaFunctionURLResponse{}, false
+	}
+	if err != nil {
+		return httpError(errorStatus(err), fmt.Errorf("getting s3://%s/%s: %w", bucket, key, err)), true
+	}
+	defer out.Body.Close()
+	data, err := readLimited(out.Body, maxResponseBytes)
+	if err != nil {
+		return httpError(http.StatusBadGateway, fmt.Errorf("s3://%s/%s: %w", bucket, key, err)), true
+	}
+	headers := map[string]string{"Cache-Control": aws.ToString(out.CacheControl)}
+	if out.ContentType != nil {
+		headers["Content-Type"] = *out.ContentType
+	}
+	if headers["Cache-Control"] == "" {
+		delete(headers, "Cache-Control")
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode:      http.StatusOK,
+		Headers:         headers,
+		Body:            base64.StdEncoding.EncodeToString(data),
+		IsBase64Encoded: true,
+	}, true
+}
+
+// readLimited reads all of r, failing once it holds more than limit bytes.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("larger than the %d bytes an HTTP response can carry", limit)
+	}
+	return data, nil
+}
+
+// findSource finds the one source image directly in dir, whose name without
+// extension is stem when the template uses {sourceStem}. Generating from a
+// guess would publish the wrong photo, so several candidates are an error.
+func findSource(ctx context.Context, client s3API, bucket, dir, stem string) (string, error) {
+	var found []string
+	in := &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(dir + "/"), Delimiter: aws.String("/")}
+	for {
+		out, err := client.ListObjectsV2(ctx, in)
+		if err != nil {
+			return "", fmt.Errorf("listing s3://%s/%s/: %w", bucket, dir, err)
+		}
+		for _, obj := range out.Contents {
+			key := aws.ToString(obj.Key)
+			name := strings.TrimPrefix(key, dir+"/")
+			if strings.Contains(name, "/") || !sourceExtensions[strings.ToLower(path.Ext(name))] {
+				continue
+			}
+			if stem != "" && sourceStem(name) != stem {
+				continue
+			}
+			found = append(found, key)
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			break
+		}
+		in.ContinuationToken = out.NextContinuationToken
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%w: no source image in s3://%s/%s/", errNoSource, bucket, dir)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%w: s3://%s/%s/ holds %d source images: %s",
+		errAmbiguousSource, bucket, dir, len(found), strings.Join(found, ", "))
+}
+
+var (
+	errNoSource        = errors.New("source not found")
+	errAmbiguousSource = errors.New("ambiguous source")
+)
+
+// errorStatus maps an error to the HTTP status that describes it.
+func errorStatus(err error) int {
+	var decErr *decodeError
+	var noKey *types.NoSuchKey
+	var notFound *types.NotFound
+	switch {
+	case errors.Is(err, ErrTooLarge) || errors.Is(err, ErrTooManyFrames):
+		return http.StatusRequestEntityTooLarge
+	case errors.As(err, &decErr):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &noKey) || errors.As(err, &notFound) || errors.Is(err, errNoSource) ||
+		errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, errAmbiguousSource):
+		return http.StatusConflict
+	case temporaryError(err):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func httpError(code int, err error) events.LambdaFunctionURLResponse {
+	body, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return events.LambdaFunctionURLResponse{
+		StatusCode: code,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}
+}
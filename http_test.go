@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func httpRequest(method, rawPath string) events.LambdaFunctionURLRequest {
+	var req events.LambdaFunctionURLRequest
+	req.RequestContext.HTTP.Method = method
+	req.RawPath = rawPath
+	return req
+}
+
+func httpTestSettings() settings {
+	return settings{destinationBucket: "dest", sourceBucket: "src",
+		dims: map[string]ImageSize{"400": {400, 300}}, formats: getDefaultImageTypes(), thumbSize: 64}
+}
+
+// TestHandleHTTPPost: both kinds of POST answer with the set's manifest, and
+// a bad upload with the status that describes it.
+func TestHandleHTTPPost(t *testing.T) {
+	img := testPNG(t, 800, 600)
+	upload := func(key string, body []byte) events.LambdaFunctionURLRequest {
+		req := httpRequest("POST", "/")
+		req.QueryStringParameters = map[string]string{"key": key}
+		req.Body = base64.StdEncoding.EncodeToString(body)
+		req.IsBase64Encoded = true
+		return req
+	}
+	source := func(bucket, key string) events.LambdaFunctionURLRequest {
+		req := httpRequest("POST", "/")
+		req.Headers = map[string]string{"content-type": "application/json"}
+		req.Body = `{"bucket":"` + bucket + `","key":"` + key + `"}`
+		return req
+	}
+	small := httpTestSettings()
+	small.limits.maxInputBytes = 100
+	strict := httpTestSettings()
+	strict.rules.minWidth = 1000
+	noSource := httpTestSettings()
+	noSource.sourceBucket = ""
+	filtered := httpTestSettings()
+	var err error
+	if filtered.filter.exclude, err = parseKeyPatterns("tags/**"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		cfg        settings
+		req        events.LambdaFunctionURLRequest
+		wantStatus int
+		wantBody   string
+	}{
+		{"upload", httpTestSettings(), upload("tags/bread/orig.png", img), 200, `"tags/bread/orig.png"`},
+		{"source", httpTestSettings(), source("src", "tags/soup/orig.png"), 200, `"etag-tags/soup/orig.png"`},
+		{"no key", httpTestSettings(), upload("", img), 400, "?key="},
+		{"not an image", httpTestSettings(), upload("tags/bread/orig.png", []byte("garbage")), 422, "decoding"},
+		{"too large", small, upload("tags/bread/orig.png", img), 413, "too large"},
+		{"rejected", strict, upload("tags/bread/orig.png", img), 422, "too_small"},
+		{"missing source", httpTestSettings(), source("src", "tags/pie/orig.png"), 404, "looking up the source"},
+		{"bad json", httpTestSettings(), source("src", `"`), 400, "reading the request"},
+		{"other bucket", httpTestSettings(), source("elsewhere", "tags/soup/orig.png"), 403, "SOURCE_BUCKET"},
+		{"no source bucket", noSource, source("src", "tags/soup/orig.png"), 403, "SOURCE_BUCKET"},
+		{"filtered upload", filtered, upload("tags/bread/orig.png", img), 403, "EXCLUDE_PATTERNS"},
+		{"filtered source", filtered, source("src", "tags/soup/orig.png"), 403, "EXCLUDE_PATTERNS"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeS3{objects: map[string][]byte{"tags/soup/orig.png": img}}
+			resp := handleHTTP(context.Background(), fake, tc.cfg, tc.req)
+			if resp.StatusCode != tc.wantStatus || !strings.Contains(resp.Body, tc.wantBody) {
+				t.Errorf("got %d %s, want %d containing %q", resp.StatusCode, resp.Body, tc.wantStatus, tc.wantBody)
+			}
+			if resp.StatusCode == 200 {
+				var m Manifest
+				if err := json.Unmarshal([]byte(resp.Body), &m); err != nil || len(m.Derivatives) == 0 {
+					t.Errorf("body is not a manifest: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestHandleHTTPGet: a missing file is generated from its source and served;
+// one the set does not contain is not generated at all.
+func TestHandleHTTPGet(t *testing.T) {
+	img := testPNG(t, 800, 600)
+	fake := &fakeS3{objects: map[string][]byte{
+		"tags/bread/orig.png":  img,
+		"tags/bread/notes.txt": []byte("not a photo"),
+		"tags/two/a.png":       img,
+		"tags/two/b.jpg":       img,
+	}}
+	cfg := httpTestSettings()
+	get := func(path string) events.LambdaFunctionURLResponse {
+		return handleHTTP(context.Background(), fake, cfg, httpRequest("GET", path))
+	}
+
+	resp := get("/tags/bread/400.webp")
+	if resp.StatusCode != 200 || resp.Headers["Content-Type"] != "image/webp" || !resp.IsBase64Encoded {
+		t.Fatalf("generating: got %d %v %s", resp.StatusCode, resp.Headers, resp.Body)
+	}
+	if data, _ := base64.StdEncoding.DecodeString(resp.Body); len(data) == 0 || string(data) != string(fake.bodies["tags/bread/400.webp"]) {
+		t.Error("served body is not the generated file")
+	}
+	puts := len(fake.puts)
+	if resp := get("/tags/bread/400.webp"); resp.StatusCode != 200 || len(fake.puts) != puts {
+		t.Errorf("existing file: got %d after %d more uploads, want 200 and none", resp.StatusCode, len(fake.puts)-puts)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/tags/bread/999.webp", 404}, // not a configured size
+		{"/tags/bread/400.gif", 404},
+		{"/tags/pie/400.webp", 404}, // no source
+		{"/tags/two/400.webp", 409}, // which source?
+		{"/tags/bread/%zz.webp", 400},
+	} {
+		if resp := get(tc.path); resp.StatusCode != tc.want {
+			t.Errorf("GET %s = %d %s, want %d", tc.path, resp.StatusCode, resp.Body, tc.want)
+		}
+	}
+	if len(fake.puts) != puts {
+		t.Errorf("%d uploads for files that cannot be generated", len(fake.puts)-puts)
+	}
+
+	if resp := handleHTTP(context.Background(), fake, cfg, httpRequest("DELETE", "/tags/bread/400.webp")); resp.StatusCode != 405 || resp.Headers["Allow"] == "" {
+		t.Errorf("DELETE = %d %v, want 405 with Allow", resp.StatusCode, resp.Headers)
+	}
+}
+
+// TestHandleHTTPGetCurrentSet: a GET only processes a source whose set is not
+// current, so made-up names and rejected sources cost no work.
+func TestHandleHTTPGetCurrentSet(t *testing.T) {
+	img := testPNG(t, 800, 600)
+	for _, tc := range []struct {
+		name       string
+		generated  bool // a set of the source exists before the GETs
+		change     func(*settings)
+		path       string
+		wantStatus int
+		wantPuts   int // for both GETs
+	}{
+		// The set predates the 800 size, and the source has not changed.
+		{"current set", true, func(cfg *settings) { cfg.dims["800"] = ImageSize{800, 600} }, "/tags/bread/800.webp", 404, 0},
+		{"rejected", false, func(cfg *settings) { cfg.rules.minWidth = 1000 }, "/tags/bread/400.webp", 422, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeS3{objects: map[string][]byte{"tags/bread/orig.png": img}}
+			cfg := httpTestSettings()
+			if tc.generated {
+				handleHTTP(context.Background(), fake, cfg, httpRequest("GET", "/tags/bread/400.webp"))
+			}
+			tc.change(&cfg)
+			puts := len(fake.puts)
+			for i := 0; i < 2; i++ {
+				if resp := handleHTTP(context.Background(), fake, cfg, httpRequest("GET", tc.path)); resp.StatusCode != tc.wantStatus {
+					t.Fatalf("GET %d = %d %s, want %d", i, resp.StatusCode, resp.Body, tc.wantStatus)
+				}
+			}
+			if got := len(fake.puts) - puts; got != tc.wantPuts {
+				t.Errorf("%d uploads, want %d", got, tc.wantPuts)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Key templates decide where each image lands in the destination bucket. The
+// default reproduces the original "one folder per image" layout.
+const (
+	defaultKeyTemplate = "{prefix}/{name}.{ext}"
+	// hashedKeyTemplate is what HASHED_KEYS=true selects.
+	hashedKeyTemplate = "{prefix}/{name}.{hash}.{ext}"
+	// PER_FILE_OUTPUT=true gives every source file its own folder, so photos
+	// uploaded to the same folder no longer overwrite each other's sets.
+	perFileKeyTemplate       = "{prefix}/{sourceStem}/{name}.{ext}"
+	perFileHashedKeyTemplate = "{prefix}/{sourceStem}/{name}.{hash}.{ext}"
+)
+
+// keyPlaceholders are the names a template may use. The first two describe
+// the upload and are the same for every file of a set; the rest are per file.
+//
+//	{prefix}      the source key's directory, e.g. media/images/tags/bread
+//	{sourceStem}  the source file name without its extension, e.g. IMG_0042
+//	{name}        the derivative name: orig, thumbnail, 1200, ...
+//	{width}       pixel width of the file
+//	{height}      pixel height of the file
+//	{format}      jpeg, webp or png
+//	{ext}         the file extension; the same as {format}
+//	{hash}        six hex digits of the file's SHA-256
+var keyPlaceholders = map[string]bool{
+	"prefix": false, "sourceStem": false,
+	"name": true, "width": true, "height": true, "format": true, "ext": true, "hash": true,
+}
+
+// keyTemplate is a parsed KEY_TEMPLATE: alternating literal text and
+// placeholder names.
+type keyTemplate struct {
+	raw   string
+	parts []keyPart
+}
+
+type keyPart struct {
+	literal     string
+	placeholder string // set instead of literal
+}
+
+// parseKeyTemplate validates a template. Every file of a set must get its own
+// key, so {name} and one of {ext} or {format} are required.
+func parseKeyTemplate(raw string) (keyTemplate, error) {
+	t := keyTemplate{raw: raw}
+	if strings.TrimSpace(raw) == "" {
+		return t, fmt.Errorf("empty key template")
+	}
+	seen := map[string]bool{}
+	rest := raw
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.parts = append(t.parts, keyPart{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return t, fmt.Errorf("key template %q: unmatched }", raw)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, keyPart{literal: rest[:open]})
+		}
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return t, fmt.Errorf("key template %q: unclosed {", raw)
+		}
+		name := rest[open+1 : open+1+end]
+		if _, ok := keyPlaceholders[name]; !ok {
+			return t, fmt.Errorf("key template %q: unknown placeholder {%s}", raw, name)
+		}
+		seen[name] = true
+		t.parts = append(t.parts, keyPart{placeholder: name})
+		rest = rest[open+2+end:]
+	}
+
+	switch {
+	case !seen["name"]:
+		return t, fmt.Errorf("key template %q: must contain {name}, or every derivative gets the same key", raw)
+	case !seen["ext"] && !seen["format"]:
+		return t, fmt.Errorf("key template %q: must contain {ext} or {format}, or the formats overwrite each other", raw)
+	case strings.HasPrefix(raw, "/") || strings.HasSuffix(raw, "/"):
+		return t, fmt.Errorf("key template %q: must not start or end with /", raw)
+	}
+	for _, seg := range strings.Split(raw, "/") {
+		if seg == "." || seg == ".." {
+			return t, fmt.Errorf("key template %q: %q segments are not allowed", raw, seg)
+		}
+	}
+	if !t.stemBounded() {
+		return t, fmt.Errorf("key template %q: {sourceStem} must have a / or . on each side, or the cleanup "+
+			"function could take one photo's files for another's whose name starts the same", raw)
+	}
+	if seen["sourceStem"] && !strings.Contains(t.setDirTemplate(), "{sourceStem}") {
+		return t, fmt.Errorf("key template %q: {sourceStem} must be part of the set's folder, or every photo "+
+			"in a folder shares one manifest.json; use a folder per source such as {prefix}/{sourceStem}/", raw)
+	}
+	return t, nil
+}
+
+// stemBounded reports whether every {sourceStem} is delimited by / or ., or
+// the start or end of the template. A stem never contains /, and names never
+// contain . or /, so that is what keeps stem "a" from matching the keys of
+// "a-b" or "a.b".
+func (t keyTemplate) stemBounded() bool {
+	for i, p := range t.parts {
+		if p.placeholder != "sourceStem" {
+			continue
+		}
+		if i > 0 && !strings.HasSuffix(t.parts[i-1].literal, "/") && !strings.HasSuffix(t.parts[i-1].literal, ".") {
+			return false
+		}
+		if i < len(t.parts)-1 && !strings.HasPrefix(t.parts[i+1].literal, "/") && !strings.HasPrefix(t.parts[i+1].literal, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+func (t keyTemplate) String() string { return t.raw }
+
+// withDefault returns the default template for the zero keyTemplate, so a
+// settings literal without one keeps the original layout.
+func (t keyTemplate) withDefault() keyTemplate {
+	if t.parts == nil {
+		t, _ = parseKeyTemplate(defaultKeyTemplate)
+	}
+	return t
+}
+
+// loadKeyTemplate reads KEY_TEMPLATE. HASHED_KEYS=true and
+// PER_FILE_OUTPUT=true are shorthands for the built-in templates, so setting
+// either with KEY_TEMPLATE is ambiguous and refused.
+func loadKeyTemplate() (keyTemplate, error) {
+	hashed, err := envBool("HASHED_KEYS")
+	if err != nil {
+		return keyTemplate{}, err
+	}
+	perFile, err := envBool("PER_FILE_OUTPUT")
+	if err != nil {
+		return keyTemplate{}, err
+	}
+	raw := os.Getenv("KEY_TEMPLATE")
+	switch {
+	case raw != "" && hashed:
+		return keyTemplate{}, fmt.Errorf("KEY_TEMPLATE and HASHED_KEYS are both set; put {hash} in KEY_TEMPLATE instead")
+	case raw != "" && perFile:
+		return keyTemplate{}, fmt.Errorf("KEY_TEMPLATE and PER_FILE_OUTPUT are both set; put {sourceStem} in KEY_TEMPLATE instead")
+	case perFile && hashed:
+		raw = perFileHashedKeyTemplate
+	case perFile:
+		raw = perFileKeyTemplate
+	case hashed:
+		raw = hashedKeyTemplate
+	case raw == "":
+		raw = defaultKeyTemplate
+	}
+	t, err := parseKeyTemplate(raw)
+	if err != nil {
+		return t, fmt.Errorf("KEY_TEMPLATE: %w", err)
+	}
+	return t, nil
+}
+
+// hashed reports whether keys change with content, in which case replacing a
+// photo leaves the previous generation behind to be cleaned up.
+func (t keyTemplate) hashed() bool {
+	for _, p := range t.parts {
+		if p.placeholder == "hash" {
+			return true
+		}
+	}
+	return false
+}
+
+// render substitutes vars and drops the empty path segments a blank
+// placeholder leaves, so "{prefix}/{name}.{ext}" at the bucket root is
+// "1200.webp" rather than "/1200.webp".
+func (t keyTemplate) render(vars map[string]string) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.placeholder != "" {
+			b.WriteString(vars[p.placeholder])
+		} else {
+			b.WriteString(p.literal)
+		}
+	}
+	return cleanKey(b.String())
+}
+
+// cleanKey drops empty path segments.
+func cleanKey(key string) string {
+	segs := strings.Split(key, "/")
+	kept := segs[:0]
+	for _, s := range segs {
+		if s != "" {
+			kept = append(kept, s)
+		}
+	}
+	return strings.Join(kept, "/")
+}
+
+// key is the object key for an image derivative.
+func (t keyTemplate) key(prefix, stem string, d Derivative) string {
+	hash := d.Hash
+	if hash == "" {
+		sum := sha256.Sum256(d.Data)
+		hash = hex.EncodeToString(sum[:])[:contentHashLength]
+	}
+	return t.render(map[string]string{
+		"prefix":     prefix,
+		"sourceStem": stem,
+		"name":       d.Name,
+		"width":      strconv.Itoa(d.Width),
+		"height":     strconv.Itoa(d.Height),
+		"format":     d.Format.String(),
+		"ext":        d.Format.String(),
+		"hash":       hash,
+	})
+}
+
+// setDir is the directory holding the set's fixed-name files (meta.json,
+// manifest.json, picture.html, rejected.json): the template's directories up
+// to the first one that varies per file. It is {prefix} for the default
+// template, and renditions/IMG_0042 for
+// "renditions/{sourceStem}/{name}@{width}w.{ext}".
+func (t keyTemplate) setDir(prefix, stem string) string {
+	return cleanKey(strings.NewReplacer("{prefix}", prefix, "{sourceStem}", stem).Replace(t.setDirTemplate()))
+}
+
+// setDirTemplate is setDir before the placeholders are filled in. The cut is
+// made on the template text, not the rendered key: {prefix} itself contains
+// slashes.
+func (t keyTemplate) setDirTemplate() string {
+	var fixed strings.Builder
+	for _, p := range t.parts {
+		if keyPlaceholders[p.placeholder] {
+			break
+		}
+		if p.placeholder != "" {
+			fixed.WriteString("{" + p.placeholder + "}")
+		} else {
+			fixed.WriteString(p.literal)
+		}
+	}
+	dir := fixed.String()
+	if i := strings.LastIndex(dir, "/"); i >= 0 {
+		return dir[:i]
+	}
+	return ""
+}
+
+// under reports whether every key the template renders, and so every file of
+// a set, starts with dir followed by a slash.
+func (t keyTemplate) under(dir string) bool {
+	return len(t.parts) > 0 && strings.HasPrefix(t.parts[0].literal, dir+"/")
+}
+
+// placeholderPatterns is what each placeholder can render to, for reading
+// keys back.
+var placeholderPatterns = map[string]string{
+	"prefix":     `.+`,
+	"sourceStem": `[^/]+`,
+	"name":       `[^/]+?`,
+	"width":      `[0-9]+`,
+	"height":     `[0-9]+`,
+	"format":     `jpeg|webp|png`,
+	"ext":        `jpeg|webp|png`,
+	"hash":       `[0-9a-f]+`,
+}
+
+// parse reads the placeholders back out of a key the template produced, the
+// inverse of key. It reports false for a key the template cannot produce. A
+// placeholder used twice must match the same text both times.
+func (t keyTemplate) parse(key string) (map[string]string, bool) {
+	var b strings.Builder
+	var names []string
+	b.WriteString("^")
+	for _, p := range t.parts {
+		if p.placeholder == "" {
+			b.WriteString(regexp.QuoteMeta(p.literal))
+			continue
+		}
+		names = append(names, p.placeholder)
+		b.WriteString("(" + placeholderPatterns[p.placeholder] + ")")
+	}
+	b.WriteString("$")
+	m := regexp.MustCompile(b.String()).FindStringSubmatch(key)
+	if m == nil {
+		return nil, false
+	}
+	vars := map[string]string{}
+	for i, name := range names {
+		if v, seen := vars[name]; seen && v != m[i+1] {
+			return nil, false
+		}
+		vars[name] = m[i+1]
+	}
+	// {format} and {ext} render the same value.
+	if f, ok := vars["format"]; ok && vars["ext"] != "" && vars["ext"] != f {
+		return nil, false
+	}
+	return vars, true
+}
+
+// sourceStem is a source key's file name without its extension.
+func sourceStem(filename string) string {
+	return strings.TrimSuffix(filename, path.Ext(filename))
+}
+
+// assignKeys sets every derivative's object key: images from the template,
+// the fixed-name files in the set directory.
+func assignKeys(derivatives []Derivative, t keyTemplate, prefix, stem string) {
+	dir := t.setDir(prefix, stem)
+	for i, d := range derivatives {
+		if d.Format.isImage() {
+			derivatives[i].Key = t.key(prefix, stem, d)
+		} else {
+			derivatives[i].Key = objectKey(dir, d.Filename())
+		}
+	}
+}
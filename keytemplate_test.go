@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func mustKeyTemplate(t *testing.T, raw string) keyTemplate {
+	t.Helper()
+	k, err := parseKeyTemplate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestParseKeyTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		raw     string
+		wantErr string
+	}{
+		{defaultKeyTemplate, ""},
+		{hashedKeyTemplate, ""},
+		{"{prefix}/{format}/{name}.{ext}", ""},
+		{"renditions/{sourceStem}/{name}@{width}w.{ext}", ""},
+		{"{prefix}/{name}-{width}x{height}.{format}", ""},
+		{"", "empty"},
+		{"{prefix}/{name}.{ext", "unclosed"},
+		{"{prefix}/{na{me}.{ext}", "unclosed"},
+		{"{prefix}/name}.{ext}", "unmatched"},
+		{"{prefix}/{size}/{name}.{ext}", "unknown placeholder {size}"},
+		{"{prefix}/orig.{ext}", "{name}"},
+		{"{prefix}/{name}.jpeg", "{ext} or {format}"},
+		{"/{prefix}/{name}.{ext}", "start or end"},
+		{"{prefix}/{name}.{ext}/", "start or end"},
+		{"{prefix}/../{name}.{ext}", `".."`},
+		{"{prefix}/{sourceStem}-{name}.{ext}", "{sourceStem} must have"},
+		{"{prefix}/img-{sourceStem}/{name}.{ext}", "{sourceStem} must have"},
+		{"{prefix}{sourceStem}/{name}.{ext}", "{sourceStem} must have"},
+		{"{prefix}/{sourceStem}.{name}.{ext}", "set's folder"},
+		{"{prefix}/{name}/{sourceStem}.{ext}", "set's folder"},
+	} {
+		t.Run(tc.raw, func(t *testing.T) {
+			_, err := parseKeyTemplate(tc.raw)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("error %v, want one mentioning %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyTemplateRender(t *testing.T) {
+	d := Derivative{Name: "1200", Format: FormatWEBP, Width: 1090, Height: 817, Data: []byte("x")}
+	for _, tc := range []struct {
+		raw, prefix, stem string
+		wantKey, wantDir  string
+	}{
+		{defaultKeyTemplate, "media/tags/bread", "IMG_1", "media/tags/bread/1200.webp", "media/tags/bread"},
+		{defaultKeyTemplate, "", "IMG_1", "1200.webp", ""}, // a root-level source
+		{hashedKeyTemplate, "a", "s", "a/1200.2d7116.webp", "a"},
+		{"{prefix}/{format}/{name}.{ext}", "a/b", "s", "a/b/webp/1200.webp", "a/b"},
+		{"renditions/{sourceStem}/{name}@{width}w.{ext}", "a/b", "IMG_1", "renditions/IMG_1/1200@1090w.webp", "renditions/IMG_1"},
+		{"{prefix}/{sourceStem}.set/{name}.{ext}", "a", "IMG_1", "a/IMG_1.set/1200.webp", "a/IMG_1.set"},
+		{"{sourceStem}/{name}.{ext}", "a", "IMG_1", "IMG_1/1200.webp", "IMG_1"},
+		{"{prefix}/{sourceStem}/{width}x{height}/{name}.{ext}", "a", "s", "a/s/1090x817/1200.webp", "a/s"},
+	} {
+		k := mustKeyTemplate(t, tc.raw)
+		if got := k.key(tc.prefix, tc.stem, d); got != tc.wantKey {
+			t.Errorf("%s: key = %q, want %q", tc.raw, got, tc.wantKey)
+		}
+		if got := k.setDir(tc.prefix, tc.stem); got != tc.wantDir {
+			t.Errorf("%s: setDir = %q, want %q", tc.raw, got, tc.wantDir)
+		}
+	}
+}
+
+// TestKeyTemplateParse: parse reads back what key wrote, and refuses keys
+// the template cannot produce.
+func TestKeyTemplateParse(t *testing.T) {
+	for _, tc := range []struct {
+		raw, key string
+		want     map[string]string // nil: no match
+	}{
+		{defaultKeyTemplate, "media/tags/bread/1200.webp",
+			map[string]string{"prefix": "media/tags/bread", "name": "1200", "ext": "webp"}},
+		{hashedKeyTemplate, "a/1200.2d7116.webp",
+			map[string]string{"prefix": "a", "name": "1200", "hash": "2d7116", "ext": "webp"}},
+		{perFileKeyTemplate, "a/b/IMG_1/orig.jpeg",
+			map[string]string{"prefix": "a/b", "sourceStem": "IMG_1", "name": "orig", "ext": "jpeg"}},
+		{"{prefix}/{format}/{name}.{ext}", "a/webp/1200.webp",
+			map[string]string{"prefix": "a", "format": "webp", "name": "1200", "ext": "webp"}},
+		{"{prefix}/{format}/{name}.{ext}", "a/png/1200.webp", nil}, // {format} and {ext} are one value
+		{defaultKeyTemplate, "media/tags/bread/1200.gif", nil},
+		{defaultKeyTemplate, "1200.webp", nil}, // a root-level set has no {prefix} to read
+		{"renditions/{sourceStem}/{name}.{ext}", "media/IMG_1/1200.webp", nil},
+	} {
+		got, ok := mustKeyTemplate(t, tc.raw).parse(tc.key)
+		if tc.want == nil {
+			if ok {
+				t.Errorf("%s: parse(%q) = %v, want no match", tc.raw, tc.key, got)
+			}
+			continue
+		}
+		if !ok || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: parse(%q) = %v, %v, want %v", tc.raw, tc.key, got, ok, tc.want)
+		}
+	}
+}
+
+func TestLoadKeyTemplate(t *testing.T) {
+	t.Setenv("KEY_TEMPLATE", "")
+	t.Setenv("HASHED_KEYS", "")
+	t.Setenv("PER_FILE_OUTPUT", "")
+	if k, err := loadKeyTemplate(); err != nil || k.String() != defaultKeyTemplate {
+		t.Errorf("default: %v, %v", k, err)
+	}
+	t.Setenv("HASHED_KEYS", "true")
+	if k, err := loadKeyTemplate(); err != nil || k.String() != hashedKeyTemplate || !k.hashed() {
+		t.Errorf("HASHED_KEYS: %v, %v", k, err)
+	}
+	t.Setenv("KEY_TEMPLATE", "{prefix}/{name}.{ext}")
+	if _, err := loadKeyTemplate(); err == nil {
+		t.Error("accepted both KEY_TEMPLATE and HASHED_KEYS")
+	}
+	t.Setenv("HASHED_KEYS", "")
+	t.Setenv("PER_FILE_OUTPUT", "true")
+	if _, err := loadKeyTemplate(); err == nil {
+		t.Error("accepted both KEY_TEMPLATE and PER_FILE_OUTPUT")
+	}
+	t.Setenv("KEY_TEMPLATE", "")
+	if k, err := loadKeyTemplate(); err != nil || k.String() != perFileKeyTemplate {
+		t.Errorf("PER_FILE_OUTPUT: %v, %v", k, err)
+	}
+	t.Setenv("HASHED_KEYS", "true")
+	if k, err := loadKeyTemplate(); err != nil || k.String() != perFileHashedKeyTemplate {
+		t.Errorf("PER_FILE_OUTPUT and HASHED_KEYS: %v, %v", k, err)
+	}
+	t.Setenv("HASHED_KEYS", "")
+	t.Setenv("PER_FILE_OUTPUT", "")
+	t.Setenv("KEY_TEMPLATE", "{prefix}/{bogus}.{ext}")
+	if _, err := loadKeyTemplate(); err == nil || !strings.HasPrefix(err.Error(), "KEY_TEMPLATE:") {
+		t.Errorf("error %v does not name the variable", err)
+	}
+}
+
+// TestHandleRecordPerFileOutput: two photos uploaded to the same folder get a
+// set each instead of overwriting one.
+func TestHandleRecordPerFileOutput(t *testing.T) {
+	fake := &fakeS3{object: testPNG(t, 800, 600)}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64,
+		keys: mustKeyTemplate(t, perFileKeyTemplate)}
+	for _, key := range []string{"tags/bread/IMG_1.png", "tags/bread/IMG_2.png"} {
+		rec := events.S3EventRecord{}
+		rec.S3.Bucket.Name = "src"
+		rec.S3.Object.Key = key
+		if err := handleS3Record(context.Background(), fake, cfg, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, stem := range []string{"IMG_1", "IMG_2"} {
+		for _, name := range []string{"orig.jpeg", "400.webp", "meta.json", "manifest.json"} {
+			if key := "tags/bread/" + stem + "/" + name; fake.bodies[key] == nil {
+				t.Errorf("%s was not uploaded", key)
+			}
+		}
+	}
+	if _, ok := fake.bodies["tags/bread/orig.jpeg"]; ok {
+		t.Error("wrote to the shared folder")
+	}
+}
+
+// TestHandleRecordKeyTemplate: images follow the template, the fixed-name
+// files sit in the set directory, and the manifest records every key.
+func TestHandleRecordKeyTemplate(t *testing.T) {
+	fake := &fakeS3{object: testPNG(t, 800, 600)}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64,
+		keys: mustKeyTemplate(t, "renditions/{sourceStem}/{format}/{name}@{width}w.{ext}")}
+	rec := events.S3EventRecord{}
+	rec.S3.Bucket.Name = "src"
+	rec.S3.Object.Key = "media/tags/bread/IMG_1.png"
+	if err := handleS3Record(context.Background(), fake, cfg, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{
+		"renditions/IMG_1/webp/400@400w.webp",
+		"renditions/IMG_1/jpeg/orig@800w.jpeg",
+		"renditions/IMG_1/jpeg/thumbnail@64w.jpeg",
+		"renditions/IMG_1/meta.json",
+		"renditions/IMG_1/manifest.json",
+	} {
+		if _, ok := fake.bodies[key]; !ok {
+			t.Errorf("%s was not uploaded", key)
+		}
+	}
+	m, err := parseManifest(fake.bodies["renditions/IMG_1/manifest.json"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range m.Derivatives {
+		if _, ok := fake.bodies[e.Key]; !ok {
+			t.Errorf("manifest lists key %q, which was not uploaded", e.Key)
+		}
+		if !strings.HasSuffix(e.Key, "/"+e.Filename) {
+			t.Errorf("filename %q is not the last segment of %q", e.Filename, e.Key)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -12,16 +13,55 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dupes" {
+		if err := runDupes(context.Background(), os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	runLocal := flag.Bool("local", false, "Run locally")
 	input := flag.String("input", "", "Absolute path to input file")
 	outputDir := flag.String("output", "", "Absolute path to output directory")
 	formats := flag.String("formats", "", "Comma separated list of output formats, e.g. \"jpeg,webp,png\" - default \"jpeg,webp\"")
 	dimStr := flag.String("dims", "", "List of output dimensions formatted as name1:width1,height1;name2:width2,height2")
 	thumbSize := flag.Int("thumbSize", defaultThumbSize, "Size of thumbnail in px - default 128")
+	printHTML := flag.Bool("print-html", false, "Write picture.html and print the <picture> snippet to stdout")
+	hashedKeys := flag.Bool("hashedKeys", false, "Put a content hash in image file names, e.g. 1200.3fa2c1.webp, and remove the previous generation")
+	serve := flag.Bool("serve", false, "Serve on-demand resizes over HTTP at /resize/{options}/{source key}")
+	addr := flag.String("addr", ":8080", "With --serve: address to listen on")
+	source := flag.String("source", "", "With --serve: directory or s3://bucket/prefix to read sources from")
+	endpoint := flag.String("s3Endpoint", "", "With --serve: URL of an S3-compatible endpoint, e.g. http://localhost:9000")
+	cacheDir := flag.String("cacheDir", "", "With --serve: directory to cache resizes in - default in memory")
+	cacheMB := flag.Int("cacheMB", 256, "With --serve: size of the in-memory cache in MB")
 	flag.Parse()
 
+	if *serve {
+		if *source == "" {
+			flag.Usage()
+			log.Fatal("--source is required with --serve")
+		}
+		if err := runServe(context.Background(), *addr, *source, *endpoint, *cacheDir, *cacheMB); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if !*runLocal {
-		lambda.Start(Handler)
+		warmup, err := heicWarmupEnabled()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if warmup {
+			// A failed warm-up is only a missed optimisation; the first real
+			// HEIC will compile the decoder instead.
+			if d, err := warmUpHEIC(); err != nil {
+				fmt.Fprintf(os.Stderr, "HEIC warm-up failed after %v: %v\n", d.Round(time.Millisecond), err)
+			} else {
+				fmt.Printf("HEIC warm-up: decoder ready in %v\n", d.Round(time.Millisecond))
+			}
+		}
+		lambda.Start(Dispatch)
 		return
 	}
 
@@ -29,12 +69,12 @@ func main() {
 		flag.Usage()
 		log.Fatal("--input and --output are required with --local")
 	}
-	if err := runLocalMode(*input, *outputDir, *formats, *dimStr, *thumbSize); err != nil {
+	if err := runLocalMode(*input, *outputDir, *formats, *dimStr, *thumbSize, *printHTML, *hashedKeys); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func runLocalMode(input, outputDir, formats, dimStr string, thumbSize int) error {
+func runLocalMode(input, outputDir, formats, dimStr string, thumbSize int, printHTML, hashedKeys bool) error {
 	data, err := os.ReadFile(input)
 	if err != nil {
 		return fmt.Errorf("reading %s: %w", input, err)
@@ -49,8 +89,17 @@ func runLocalMode(input, outputDir, formats, dimStr string, thumbSize int) error
 		return fmt.Errorf("reading formats: %w", err)
 	}
 
+	limits, err := loadLimits()
+	if err != nil {
+		return err
+	}
+	rules, err := loadRules()
+	if err != nil {
+		return err
+	}
+
 	start := time.Now()
-	img, format, err := decodeImage(data)
+	img, format, err := decodeImage(data, limits)
 	if err != nil {
 		return fmt.Errorf("decoding %s: %w", input, err)
 	}
@@ -58,13 +107,48 @@ func runLocalMode(input, outputDir, formats, dimStr string, thumbSize int) error
 		filepath.Base(input), format, img.Bounds().Dx(), img.Bounds().Dy(),
 		time.Since(start).Round(time.Millisecond))
 
-	derivatives, err := processImage(img, iTypes, dims, thumbSize)
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return fmt.Errorf("creating output directory %s: %w", outputDir, err)
+	}
+
+	if rej := checkAcceptance(img, rules, input); rej != nil {
+		return writeRejection(outputDir, input, rej)
+	}
+
+	derivatives, analysis, err := processImage(context.Background(), img, iTypes, dims, thumbSize)
+	releaseImage(img)
 	if err != nil {
 		return fmt.Errorf("processing image: %w", err)
 	}
+	q := analysis.Quality
+	fmt.Printf("Quality: sharpness %.2f, brightness %.2f, shadows %.4f, highlights %.4f\n",
+		q.Sharpness, q.Brightness, q.Shadows, q.Highlights)
+	if rej := checkQuality(q, rules, input, ImageSize{analysis.Width, analysis.Height}); rej != nil {
+		return writeRejection(outputDir, input, rej)
+	}
+	if hashedKeys {
+		hashFilenames(derivatives)
+	}
+	derivatives = append(derivatives, metaDerivative(analysis))
+	if printHTML {
+		// URLs are relative to the output directory unless PICTURE_BASE_URL
+		// says where it is served from.
+		base := os.Getenv("PICTURE_BASE_URL")
+		pic, err := pictureDerivative(derivatives, func(d Derivative) string { return base + d.Filename() })
+		if err != nil {
+			return err
+		}
+		derivatives = append(derivatives, pic)
+		fmt.Print(string(pic.Data))
+	}
+	source := ManifestSource{Key: input, Format: format}
+	derivatives = append(derivatives, buildManifest(source, analysis, derivatives).Derivative())
 
-	if err := os.MkdirAll(outputDir, 0o755); err != nil {
-		return fmt.Errorf("creating output directory %s: %w", outputDir, err)
+	var previous *Manifest
+	if hashedKeys {
+		if previous, err = localPreviousManifest(filepath.Join(outputDir, manifestName+".json")); err != nil {
+			return err
+		}
 	}
 	for _, d := range derivatives {
 		path := filepath.Join(outputDir, d.Filename())
@@ -72,8 +156,30 @@ func runLocalMode(input, outputDir, formats, dimStr string, thumbSize int) error
 			return fmt.Errorf("writing %s: %w", path, err)
 		}
 	}
+	// As on Lambda, a published set replaces an earlier rejection.
+	if err := os.Remove(filepath.Join(outputDir, rejectionReport)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range staleFiles(previous, derivatives, "") {
+		// filepath.Base: the names come from a file on disk, and must not
+		// reach outside the output directory.
+		if err := os.Remove(filepath.Join(outputDir, filepath.Base(name))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 
 	fmt.Printf("Wrote %d files to %s in %v\n",
 		len(derivatives), outputDir, time.Since(start).Round(time.Millisecond))
 	return nil
 }
+
+// writeRejection writes rejected.json to the output directory. Unlike the
+// Lambda, a rejection here is returned as an error: the Django dev server only
+// sees the exit status.
+func writeRejection(outputDir, input string, rej *Rejection) error {
+	path := filepath.Join(outputDir, rejectionReport)
+	if err := os.WriteFile(path, rej.JSON(), 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return fmt.Errorf("%s: %w (report written to %s)", input, rej, path)
+}
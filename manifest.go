@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path"
+	"time"
+)
+
+// manifestName is the base name of the manifest. It is written after every
+// other file, so its presence means the set is complete.
+const manifestName = "manifest"
+
+// Manifest records everything one run produced. It is the machine-readable
+// replacement for the "Uploaded N derivatives" log line: the Django app reads
+// the breakpoints from here rather than hard-coding SCREEN_SIZES.
+type Manifest struct {
+	Source      ManifestSource  `json:"source"`
+	Width       int             `json:"width"` // the oriented original
+	Height      int             `json:"height"`
+	Derivatives []ManifestEntry `json:"derivatives"`
+	Analysis    Analysis        `json:"analysis"`
+	GeneratedAt time.Time       `json:"generatedAt"`
+}
+
+// ManifestSource identifies the upload the set was generated from. Bucket and
+// ETag are empty when run from the command line, and VersionID unless the
+// source bucket is versioned.
+type ManifestSource struct {
+	Bucket    string `json:"bucket,omitempty"`
+	Key       string `json:"key"`
+	ETag      string `json:"etag,omitempty"`
+	VersionID string `json:"versionId,omitempty"`
+	Format    string `json:"format"` // as detected from the bytes, e.g. "heic"
+}
+
+// ManifestEntry describes one output file. Width, Height and Quality are
+// omitted for meta.json, which is not an image. Key is the full object key,
+// which KEY_TEMPLATE may place outside the manifest's own directory; it is
+// omitted on the command line.
+type ManifestEntry struct {
+	Name     string `json:"name"`
+	Filename string `json:"filename"`
+	Key      string `json:"key,omitempty"`
+	Format   string `json:"format"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Bytes    int    `json:"bytes"`
+	Quality  int    `json:"quality,omitempty"`
+	SHA256   string `json:"sha256"`
+}
+
+// buildManifest describes derivatives, which must not include the manifest
+// itself.
+func buildManifest(source ManifestSource, analysis Analysis, derivatives []Derivative) Manifest {
+	m := Manifest{
+		Source:      source,
+		Width:       analysis.Width,
+		Height:      analysis.Height,
+		Derivatives: make([]ManifestEntry, 0, len(derivatives)),
+		Analysis:    analysis,
+		GeneratedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	for _, d := range derivatives {
+		sum := sha256.Sum256(d.Data)
+		quality := d.Quality
+		if d.Format == FormatPNG {
+			quality = 0 // lossless: the setting was never applied
+		}
+		filename := d.Filename()
+		if d.Key != "" {
+			filename = path.Base(d.Key)
+		}
+		m.Derivatives = append(m.Derivatives, ManifestEntry{
+			Name:     d.Name,
+			Filename: filename,
+			Key:      d.Key,
+			Format:   d.Format.String(),
+			Width:    d.Width,
+			Height:   d.Height,
+			Bytes:    len(d.Data),
+			Quality:  quality,
+			SHA256:   hex.EncodeToString(sum[:]),
+		})
+	}
+	return m
+}
+
+// Derivative renders the manifest as manifest.json.
+func (m Manifest) Derivative() Derivative {
+	data, _ := json.MarshalIndent(m, "", "  ") // plain fields: cannot fail
+	return Derivative{Name: manifestName, Format: FormatJSON, Data: append(data, '\n')}
+}
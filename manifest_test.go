@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+func TestBuildManifest(t *testing.T) {
+	derivatives, analysis, err := processImage(context.Background(), synthImage(1600, 1200), getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derivatives = append(derivatives, metaDerivative(analysis))
+	source := ManifestSource{Bucket: "src", Key: "a/b.png", ETag: `"abc"`, Format: "png"}
+	m := buildManifest(source, analysis, derivatives)
+
+	if m.Source != source || m.Width != 1600 || m.Height != 1200 {
+		t.Errorf("header is %+v %dx%d", m.Source, m.Width, m.Height)
+	}
+	if len(m.Derivatives) != len(derivatives) {
+		t.Fatalf("%d entries for %d derivatives", len(m.Derivatives), len(derivatives))
+	}
+	dims := getDefaultDims()
+	for i, e := range m.Derivatives {
+		d := derivatives[i]
+		sum := sha256.Sum256(d.Data)
+		if e.Filename != d.Filename() || e.Bytes != len(d.Data) || e.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("entry %+v does not describe %s", e, d.Filename())
+		}
+		switch e.Name {
+		case "meta":
+			if e.Width != 0 || e.Quality != 0 {
+				t.Errorf("meta.json entry has image fields: %+v", e)
+			}
+		case "orig":
+			if e.Width != 1600 || e.Height != 1200 || e.Quality != defaultQuality {
+				t.Errorf("orig entry %+v", e)
+			}
+		case "thumbnail":
+			if e.Width != defaultThumbSize || e.Height != defaultThumbSize || e.Quality != thumbnailQuality {
+				t.Errorf("thumbnail entry %+v", e)
+			}
+		default:
+			want := smartDims(ImageSize{1600, 1200}, dims[e.Name])
+			if e.Width != want.Width || e.Height != want.Height {
+				t.Errorf("%s is listed as %dx%d, want %dx%d", e.Filename, e.Width, e.Height, want.Width, want.Height)
+			}
+		}
+	}
+
+	d := m.Derivative()
+	if d.Filename() != "manifest.json" {
+		t.Errorf("manifest filename %q", d.Filename())
+	}
+	var back Manifest
+	if err := json.Unmarshal(d.Data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if len(back.Derivatives) != len(m.Derivatives) || back.Analysis.BlurHash != analysis.BlurHash {
+		t.Error("manifest.json does not round-trip")
+	}
+}
+
+func TestManifestOmitsQualityForPNG(t *testing.T) {
+	derivatives, analysis, err := processImage(context.Background(), synthImage(400, 300), []ImageFormat{FormatPNG}, map[string]ImageSize{"s": {200, 150}}, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range buildManifest(ManifestSource{}, analysis, derivatives).Derivatives {
+		if e.Format == "png" && e.Quality != 0 {
+			t.Errorf("%s lists quality %d, but PNG is lossless", e.Filename, e.Quality)
+		}
+	}
+}
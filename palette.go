@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strings"
+)
+
+// paletteSize is how many colours the palette holds. Median cut may return
+// fewer for an image with fewer distinct colours.
+const paletteSize = 5
+
+// Swatch is one palette colour.
+type Swatch struct {
+	Hex string `json:"hex"` // "#rrggbb"
+	// Population is the fraction of pixels closest to this colour.
+	Population float64 `json:"population"`
+	// Text is black or white, whichever contrasts more with Hex by the WCAG
+	// 2 formula, so a recipe card can put a title on the colour. The better
+	// of the two is always at least sqrt(21) = 4.58:1, which passes AA for
+	// body text on any background.
+	Text     string  `json:"text"`
+	Contrast float64 `json:"contrast"` // the WCAG contrast ratio of Text on Hex
+}
+
+// extractPalette runs median cut over img and returns up to paletteSize
+// swatches, most populous first; the first is the dominant colour. The result
+// depends only on the pixels, so it is the same on every run. Callers pass the
+// placeholder source: 10,000 pixels is plenty for five colours.
+func extractPalette(img *image.RGBA) []Swatch {
+	b := img.Bounds()
+	px := make([][3]uint8, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			px = append(px, [3]uint8{p[0], p[1], p[2]})
+		}
+	}
+	if len(px) == 0 {
+		return nil
+	}
+
+	// Repeatedly split the box with the most to gain -- pixel count times its
+	// widest channel range -- at the median of that channel.
+	boxes := [][][3]uint8{px}
+	for len(boxes) < paletteSize {
+		best, bestScore, bestChannel := -1, 0, 0
+		for i, box := range boxes {
+			ch, r := widestChannel(box)
+			if score := len(box) * r; r > 0 && score > bestScore {
+				best, bestScore, bestChannel = i, score, ch
+			}
+		}
+		if best < 0 {
+			break // every box is a single colour
+		}
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool { return colourLess(box[i], box[j], bestChannel) })
+		mid := len(box) / 2
+		// Move the cut off a run of equal values, or the same colour would end
+		// up in both halves.
+		for mid < len(box) && mid > 0 && box[mid][bestChannel] == box[mid-1][bestChannel] {
+			mid++
+		}
+		if mid == len(box) {
+			mid = len(box) / 2
+			for mid > 0 && box[mid][bestChannel] == box[mid-1][bestChannel] {
+				mid--
+			}
+		}
+		boxes[best] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+
+	out := make([]Swatch, 0, len(boxes))
+	for _, box := range boxes {
+		var sum [3]int
+		for _, p := range box {
+			sum[0] += int(p[0])
+			sum[1] += int(p[1])
+			sum[2] += int(p[2])
+		}
+		n := len(box)
+		c := [3]uint8{uint8((sum[0] + n/2) / n), uint8((sum[1] + n/2) / n), uint8((sum[2] + n/2) / n)}
+		out = append(out, newSwatch(c, roundTo(float64(n)/float64(len(px)), 4)))
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Population != out[j].Population {
+			return out[i].Population > out[j].Population
+		}
+		return out[i].Hex < out[j].Hex
+	})
+	return out
+}
+
+// widestChannel returns the channel (0-2) with the largest range in box, and
+// that range.
+func widestChannel(box [][3]uint8) (channel, spread int) {
+	lo, hi := [3]uint8{255, 255, 255}, [3]uint8{}
+	for _, p := range box {
+		for c := 0; c < 3; c++ {
+			lo[c] = min(lo[c], p[c])
+			hi[c] = max(hi[c], p[c])
+		}
+	}
+	for c := 0; c < 3; c++ {
+		if r := int(hi[c]) - int(lo[c]); r > spread {
+			channel, spread = c, r
+		}
+	}
+	return channel, spread
+}
+
+// colourLess orders by channel first and then by the full colour, a total
+// order, so the unstable sort still yields the same boxes every run.
+func colourLess(a, b [3]uint8, channel int) bool {
+	if a[channel] != b[channel] {
+		return a[channel] < b[channel]
+	}
+	for c := 0; c < 3; c++ {
+		if a[c] != b[c] {
+			return a[c] < b[c]
+		}
+	}
+	return false
+}
+
+func newSwatch(c [3]uint8, population float64) Swatch {
+	s := Swatch{Hex: fmt.Sprintf("#%02x%02x%02x", c[0], c[1], c[2]), Population: population}
+	onBlack, onWhite := contrastRatio(c, [3]uint8{}), contrastRatio(c, [3]uint8{255, 255, 255})
+	if onBlack >= onWhite {
+		s.Text, s.Contrast = "#000000", roundTo(onBlack, 2)
+	} else {
+		s.Text, s.Contrast = "#ffffff", roundTo(onWhite, 2)
+	}
+	return s
+}
+
+// contrastRatio is the WCAG 2 contrast ratio between two colours, 1 to 21.
+func contrastRatio(a, b [3]uint8) float64 {
+	la, lb := relativeLuminance(a), relativeLuminance(b)
+	return (math.Max(la, lb) + 0.05) / (math.Min(la, lb) + 0.05)
+}
+
+// relativeLuminance is the WCAG 2 definition, on sRGB.
+func relativeLuminance(c [3]uint8) float64 {
+	return 0.2126*srgbToLinear(c[0]) + 0.7152*srgbToLinear(c[1]) + 0.0722*srgbToLinear(c[2])
+}
+
+// paletteMetadata renders the palette for S3 user metadata: the dominant
+// colour and its text colour, and every hex in order.
+func paletteMetadata(p []Swatch) map[string]string {
+	if len(p) == 0 {
+		return map[string]string{}
+	}
+	hexes := make([]string, len(p))
+	for i, s := range p {
+		hexes[i] = s.Hex
+	}
+	return map[string]string{
+		"nnr-dominant":      p[0].Hex,
+		"nnr-dominant-text": p[0].Text,
+		"nnr-palette":       strings.Join(hexes, ","),
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"reflect"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// bands fills an image with horizontal bands of colour, each covering the
+// given fraction of its height.
+func bands(w, h int, colours []color.RGBA, fractions []float64) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	y := 0
+	for i, c := range colours {
+		end := y + int(math.Round(fractions[i]*float64(h)))
+		if i == len(colours)-1 {
+			end = h
+		}
+		draw.Draw(m, image.Rect(0, y, w, end), image.NewUniform(c), image.Point{}, draw.Src)
+		y = end
+	}
+	return m
+}
+
+func TestExtractPalette(t *testing.T) {
+	img := bands(100, 100,
+		[]color.RGBA{{200, 30, 30, 255}, {20, 40, 120, 255}, {250, 250, 250, 255}},
+		[]float64{0.6, 0.3, 0.1})
+	got := extractPalette(img)
+	want := []Swatch{
+		{Hex: "#c81e1e", Population: 0.6, Text: "#ffffff"},
+		{Hex: "#142878", Population: 0.3, Text: "#ffffff"},
+		{Hex: "#fafafa", Population: 0.1, Text: "#000000"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d swatches for three flat colours: %+v", len(got), got)
+	}
+	for i := range want {
+		if got[i].Hex != want[i].Hex || got[i].Population != want[i].Population || got[i].Text != want[i].Text {
+			t.Errorf("swatch %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// TestExtractPaletteDeterministic: the same pixels give the same palette, and
+// a photo-like image fills all five slots with every text colour readable.
+func TestExtractPaletteDeterministic(t *testing.T) {
+	src := placeholderSource(placeholderFixture(400, 300))
+	defer releaseImage(src)
+	a, b := extractPalette(src), extractPalette(src)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("two runs differ:\n%+v\n%+v", a, b)
+	}
+	if len(a) != paletteSize {
+		t.Fatalf("got %d swatches, want %d", len(a), paletteSize)
+	}
+	var total float64
+	for i, s := range a {
+		total += s.Population
+		if s.Contrast < 4.5 {
+			t.Errorf("%s with %s text is only %.2f:1", s.Hex, s.Text, s.Contrast)
+		}
+		if i > 0 && s.Population > a[i-1].Population {
+			t.Errorf("swatch %d is more populous than swatch %d", i, i-1)
+		}
+	}
+	if math.Abs(total-1) > 0.001 {
+		t.Errorf("populations sum to %.4f, want 1", total)
+	}
+}
+
+func TestExtractPaletteFlat(t *testing.T) {
+	img := bands(10, 10, []color.RGBA{{10, 20, 30, 255}}, []float64{1})
+	got := extractPalette(img)
+	if len(got) != 1 || got[0].Hex != "#0a141e" || got[0].Population != 1 {
+		t.Errorf("flat image palette = %+v", got)
+	}
+	if extractPalette(image.NewRGBA(image.Rectangle{})) != nil {
+		t.Error("an empty image has a palette")
+	}
+}
+
+func TestContrastRatio(t *testing.T) {
+	for _, tc := range []struct {
+		a, b [3]uint8
+		want float64
+	}{
+		{[3]uint8{0, 0, 0}, [3]uint8{255, 255, 255}, 21},
+		{[3]uint8{255, 255, 255}, [3]uint8{255, 255, 255}, 1},
+		{[3]uint8{0x77, 0x77, 0x77}, [3]uint8{255, 255, 255}, 4.48}, // the classic AA near-miss
+	} {
+		if got := roundTo(contrastRatio(tc.a, tc.b), 2); got != tc.want {
+			t.Errorf("contrast(%v, %v) = %.2f, want %.2f", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestPaletteReachesMetadataAndManifest(t *testing.T) {
+	derivatives, analysis, err := processImage(context.Background(), placeholderFixture(800, 600), getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(analysis.Palette) == 0 || analysis.Dominant != analysis.Palette[0] {
+		t.Fatalf("dominant %+v is not the first of %+v", analysis.Dominant, analysis.Palette)
+	}
+	md := analysis.metadata()
+	if md["nnr-dominant"] != analysis.Dominant.Hex || md["nnr-dominant-text"] != analysis.Dominant.Text || md["nnr-palette"] == "" {
+		t.Errorf("metadata %v is missing the palette", md)
+	}
+	if m := buildManifest(ManifestSource{}, analysis, derivatives); len(m.Analysis.Palette) != len(analysis.Palette) {
+		t.Error("the manifest does not carry the palette")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+// The perceptual hash is the classic DCT pHash: scale to 32x32 luma, take the
+// 2D DCT, keep the 8x8 lowest frequencies and set one bit per coefficient
+// above their median. It survives re-encoding, resizing and mild colour
+// changes far better than the simpler dHash, which compares neighbouring
+// pixels and is thrown by a JPEG round trip at small sizes. It does not
+// survive rotation by itself; that is handled by hashing after EXIF
+// orientation, so a sideways phone upload hashes like the upright original.
+const (
+	phashSample = 32
+	phashBits   = 8 // 8x8 coefficients = 64 bits
+)
+
+// perceptualHash returns the 64-bit pHash of img.
+//
+// The 32x32 sample is a plain area average rather than resizeTo: processImage
+// hashes its smallest stage while the dupes scan hashes whole files, and a box
+// filter gives nearly the same sample from either, where the resampler's
+// pre-shrink and kernel make the two drift apart by several bits.
+func perceptualHash(img *image.RGBA) uint64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	var luma, weight [phashSample][phashSample]float64
+	for y := 0; y < h; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+		sy := y * phashSample / h
+		for x := 0; x < w; x++ {
+			p := row[x*4:]
+			sx := x * phashSample / w
+			luma[sy][sx] += 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+			weight[sy][sx]++
+		}
+	}
+	for y := range luma {
+		for x := range luma[y] {
+			if weight[y][x] > 0 {
+				luma[y][x] /= weight[y][x]
+			}
+		}
+	}
+
+	// Separable DCT-II, only for the coefficients we keep.
+	var cos [phashBits][phashSample]float64
+	for u := 0; u < phashBits; u++ {
+		for x := 0; x < phashSample; x++ {
+			cos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * phashSample))
+		}
+	}
+	var rows [phashSample][phashBits]float64
+	for y := 0; y < phashSample; y++ {
+		for u := 0; u < phashBits; u++ {
+			var s float64
+			for x := 0; x < phashSample; x++ {
+				s += luma[y][x] * cos[u][x]
+			}
+			rows[y][u] = s
+		}
+	}
+	coeffs := make([]float64, 0, phashBits*phashBits)
+	for v := 0; v < phashBits; v++ {
+		for u := 0; u < phashBits; u++ {
+			var s float64
+			for y := 0; y < phashSample; y++ {
+				s += rows[y][u] * cos[v][y]
+			}
+			coeffs = append(coeffs, s)
+		}
+	}
+
+	// The DC term is the mean brightness; it would dominate the median, so
+	// it is left out of it.
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << (63 - i)
+		}
+	}
+	return hash
+}
+
+// hashImage hashes a decoded image as processImage would: flattened onto
+// white, and already oriented by decodeImage.
+func hashImage(img image.Image) uint64 {
+	base := flatten(img)
+	defer releaseImage(base)
+	return perceptualHash(base)
+}
+
+// hammingDistance is the number of bits in which two hashes differ.
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// formatHash renders a hash as 16 hex digits, the form stored in metadata.
+func formatHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+func parseHash(s string) (uint64, error) {
+	if len(s) != 16 {
+		return 0, fmt.Errorf("perceptual hash %q: want 16 hex digits", s)
+	}
+	h, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("perceptual hash %q: %w", s, err)
+	}
+	return h, nil
+}
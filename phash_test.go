@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func hashFixture(t *testing.T, path string) (uint64, image.Image) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Skipf("fixture %s missing: %v", path, err)
+	}
+	img, _, err := decodeImage(data, decodeLimits{})
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return hashImage(img), img
+}
+
+// TestPerceptualHashOrientation: every EXIF orientation of a photo is the same
+// photo once decodeImage has turned it upright.
+func TestPerceptualHashOrientation(t *testing.T) {
+	for _, kind := range []string{"landscape", "portrait"} {
+		ref, _ := hashFixture(t, filepath.Join("testdata", "orientation", kind+"_1.jpg"))
+		for i := 2; i <= 8; i++ {
+			path := filepath.Join("testdata", "orientation", kind+"_"+string(rune('0'+i))+".jpg")
+			if h, _ := hashFixture(t, path); hammingDistance(h, ref) > defaultDupeThreshold {
+				t.Errorf("%s is %d bits from %s_1.jpg", path, hammingDistance(h, ref), kind)
+			}
+		}
+	}
+}
+
+// TestPerceptualHashReencode: a HEIC downscaled and saved as a low-quality
+// JPEG still matches, and the three different HEIC photos do not match each
+// other.
+func TestPerceptualHashReencode(t *testing.T) {
+	var originals []uint64
+	for _, name := range []string{"test.heic", "example.heic", "C003.heic"} {
+		h, img := hashFixture(t, filepath.Join("testdata", name))
+		originals = append(originals, h)
+
+		b := img.Bounds()
+		small := resizeTo(img, b.Dx()/3, b.Dy()/3)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, small, &jpeg.Options{Quality: 40}); err != nil {
+			t.Fatal(err)
+		}
+		again, _, err := decodeImage(buf.Bytes(), decodeLimits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := hammingDistance(h, hashImage(again)); d > defaultDupeThreshold {
+			t.Errorf("%s re-encoded as JPEG is %d bits away", name, d)
+		}
+	}
+	for i := range originals {
+		for j := i + 1; j < len(originals); j++ {
+			if d := hammingDistance(originals[i], originals[j]); d <= defaultDupeThreshold {
+				t.Errorf("different photos %d and %d are only %d bits apart", i, j, d)
+			}
+		}
+	}
+}
+
+func TestPerceptualHashInAnalysis(t *testing.T) {
+	full, img := hashFixture(t, filepath.Join("testdata", "orientation", "landscape_1.jpg"))
+	_, analysis, err := processImage(context.Background(), img, getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := parseHash(analysis.PHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hashed from the smallest stage, yet it must agree with hashing the
+	// full-size image, which is what the dupes scan does with a file.
+	if d := hammingDistance(h, full); d > 2 {
+		t.Errorf("processImage's hash is %d bits from hashImage's", d)
+	}
+	if analysis.metadata()["nnr-phash"] != analysis.PHash {
+		t.Error("nnr-phash is missing from the metadata")
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	for _, h := range []uint64{0, 1, 0xdeadbeefcafef00d, ^uint64(0)} {
+		got, err := parseHash(formatHash(h))
+		if err != nil || got != h {
+			t.Errorf("parseHash(formatHash(%x)) = %x, %v", h, got, err)
+		}
+	}
+	for _, bad := range []string{"", "abc", "zzzzzzzzzzzzzzzz", "0123456789abcdef0"} {
+		if _, err := parseHash(bad); err == nil {
+			t.Errorf("parseHash(%q) succeeded", bad)
+		}
+	}
+}
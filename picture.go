@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pictureName is the base name of the generated snippet, picture.html.
+const pictureName = "picture"
+
+// formatPreference orders <source> elements: browsers take the first type
+// they support, so the most efficient format goes first. AVIF is listed so a
+// future encoder slots in ahead of WebP without touching this file again.
+var formatPreference = map[string]int{"avif": 0, "webp": 1, "jpeg": 2, "png": 3}
+
+// pictureHTML renders a <picture> element for the breakpoint derivatives, so
+// the markup is generated from what was actually produced rather than kept in
+// step with getDefaultDims by hand.
+//
+// Each format gets one srcset with width descriptors. sizes is derived from the
+// breakpoint names, which by convention are the min-width in px they serve
+// ("1200" -> (min-width: 1200px)); names that are not numbers still appear in
+// srcset but cannot contribute a media condition. The <img> fallback is the
+// largest derivative in the least preferred format -- the most compatible one
+// -- with width and height set so the browser reserves space before loading.
+//
+// url maps a derivative to the URL the page should use for it.
+func pictureHTML(derivatives []Derivative, url func(Derivative) string) (string, error) {
+	byFormat := map[ImageFormat][]Derivative{}
+	for _, d := range derivatives {
+		if _, ok := formatPreference[d.Format.String()]; !ok || d.Name == "orig" || d.Name == "thumbnail" {
+			continue
+		}
+		byFormat[d.Format] = append(byFormat[d.Format], d)
+	}
+	if len(byFormat) == 0 {
+		return "", fmt.Errorf("no breakpoint images to build a <picture> from")
+	}
+
+	formats := make([]ImageFormat, 0, len(byFormat))
+	for f, set := range byFormat {
+		formats = append(formats, f)
+		sort.SliceStable(set, func(i, j int) bool { return set[i].Width > set[j].Width })
+	}
+	sort.Slice(formats, func(i, j int) bool {
+		return formatPreference[formats[i].String()] < formatPreference[formats[j].String()]
+	})
+
+	sizes := pictureSizes(byFormat[formats[0]])
+	var b strings.Builder
+	b.WriteString("<picture>\n")
+	for _, f := range formats[:len(formats)-1] {
+		fmt.Fprintf(&b, "  <source type=\"%s\"\n          srcset=\"%s\"\n          sizes=\"%s\">\n",
+			f.ContentType(), srcset(byFormat[f], url), sizes)
+	}
+	fallback := byFormat[formats[len(formats)-1]]
+	img := fallback[0]
+	fmt.Fprintf(&b, "  <img src=\"%s\"\n       srcset=\"%s\"\n       sizes=\"%s\"\n       width=\"%d\" height=\"%d\" alt=\"\">\n",
+		html.EscapeString(url(img)), srcset(fallback, url), sizes, img.Width, img.Height)
+	b.WriteString("</picture>\n")
+	return b.String(), nil
+}
+
+// srcset lists a format's derivatives with width descriptors, largest first.
+// An image smaller than several boxes yields the same width more than once,
+// and a srcset may not repeat a descriptor, so only the first is kept.
+func srcset(set []Derivative, url func(Derivative) string) string {
+	var parts []string
+	seen := map[int]bool{}
+	for _, d := range set {
+		if seen[d.Width] {
+			continue
+		}
+		seen[d.Width] = true
+		parts = append(parts, fmt.Sprintf("%s %dw", html.EscapeString(url(d)), d.Width))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// pictureSizes builds the sizes attribute: one media condition per numeric
+// breakpoint, widest first, each claiming the width of the image produced for
+// it, then 100vw for anything narrower than the smallest breakpoint.
+func pictureSizes(set []Derivative) string {
+	type bp struct{ minWidth, slot int }
+	var bps []bp
+	for _, d := range set {
+		if n, err := strconv.Atoi(d.Name); err == nil && n > 0 {
+			bps = append(bps, bp{n, d.Width})
+		}
+	}
+	sort.Slice(bps, func(i, j int) bool { return bps[i].minWidth > bps[j].minWidth })
+	parts := make([]string, 0, len(bps)+1)
+	for _, p := range bps {
+		parts = append(parts, fmt.Sprintf("(min-width: %dpx) %dpx", p.minWidth, p.slot))
+	}
+	return strings.Join(append(parts, "100vw"), ", ")
+}
+
+// pictureDerivative renders the snippet as picture.html.
+func pictureDerivative(derivatives []Derivative, url func(Derivative) string) (Derivative, error) {
+	snippet, err := pictureHTML(derivatives, url)
+	if err != nil {
+		return Derivative{}, err
+	}
+	return Derivative{Name: pictureName, Format: FormatHTML, Data: []byte(snippet)}, nil
+}
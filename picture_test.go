@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPictureHTML(t *testing.T) {
+	derivatives, _, err := processImage(context.Background(), synthImage(1600, 1200), getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := pictureHTML(derivatives, func(d Derivative) string { return "/media/a/" + d.Filename() })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WebP is preferred, so it is the <source>; JPEG is the <img> fallback.
+	webp, jpeg := strings.Index(out, `<source type="image/webp"`), strings.Index(out, "<img ")
+	if webp < 0 || jpeg < 0 || webp > jpeg {
+		t.Fatalf("want a webp <source> before the <img>:\n%s", out)
+	}
+	if strings.Contains(out, "orig.") || strings.Contains(out, "thumbnail.") {
+		t.Errorf("orig and thumbnail are not breakpoints:\n%s", out)
+	}
+	if !strings.Contains(out, `src="/media/a/1200.jpeg"`) {
+		t.Errorf("fallback is not the largest JPEG:\n%s", out)
+	}
+
+	dims := getDefaultDims()
+	var sizes []string
+	for _, ns := range sortedDims(dims) {
+		name := ns.Name
+		got := smartDims(ImageSize{1600, 1200}, ns.Box)
+		for _, f := range []string{"webp", "jpeg"} {
+			if s := fmt.Sprintf("/media/a/%s.%s %dw", name, f, got.Width); !strings.Contains(out, s) {
+				t.Errorf("srcset is missing %q", s)
+			}
+		}
+		sizes = append(sizes, fmt.Sprintf("(min-width: %spx) %dpx", name, got.Width))
+	}
+	if s := `sizes="` + strings.Join(sizes, ", ") + `, 100vw"`; strings.Count(out, s) != 2 {
+		t.Errorf("want %s on both elements in:\n%s", s, out)
+	}
+	big := smartDims(ImageSize{1600, 1200}, dims["1200"])
+	if s := fmt.Sprintf(`width="%d" height="%d"`, big.Width, big.Height); !strings.Contains(out, s) {
+		t.Errorf("missing %s in:\n%s", s, out)
+	}
+}
+
+func TestPictureHTMLFormatOrder(t *testing.T) {
+	set := []Derivative{
+		{Name: "800", Format: FormatPNG, Width: 800, Height: 600},
+		{Name: "800", Format: FormatJPEG, Width: 800, Height: 600},
+		{Name: "800", Format: FormatWEBP, Width: 800, Height: 600},
+	}
+	out, err := pictureHTML(set, func(d Derivative) string { return d.Filename() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	webp, jpeg, png := strings.Index(out, "image/webp"), strings.Index(out, "image/jpeg"), strings.Index(out, `src="800.png"`)
+	if webp < 0 || jpeg < 0 || png < 0 || !(webp < jpeg && jpeg < png) {
+		t.Errorf("want webp, jpeg, then the png fallback:\n%s", out)
+	}
+}
+
+// TestPictureHTMLSmallSource: a source smaller than several boxes produces
+// identically sized breakpoints, and a srcset may not repeat a descriptor.
+func TestPictureHTMLSmallSource(t *testing.T) {
+	derivatives, _, err := processImage(context.Background(), synthImage(400, 300), []ImageFormat{FormatJPEG}, getDefaultDims(), defaultThumbSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := pictureHTML(derivatives, func(d Derivative) string { return d.Filename() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out, " 400w"); n != 1 {
+		t.Errorf("400w appears %d times:\n%s", n, out)
+	}
+	if strings.Contains(out, "<source") {
+		t.Errorf("a single format needs no <source>:\n%s", out)
+	}
+}
+
+func TestPictureHTMLNoBreakpoints(t *testing.T) {
+	if _, err := pictureHTML([]Derivative{{Name: "orig", Format: FormatJPEG}, {Name: "meta", Format: FormatJSON}}, func(d Derivative) string { return d.Filename() }); err == nil {
+		t.Error("built a <picture> with no breakpoint images")
+	}
+}
+
+func TestPictureSizesSkipsNamedBreakpoints(t *testing.T) {
+	got := pictureSizes([]Derivative{{Name: "hero", Width: 1600}, {Name: "640", Width: 600}})
+	if want := "(min-width: 640px) 600px, 100vw"; got != want {
+		t.Errorf("sizes = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"image"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Placeholders are computed from a copy of the smallest chain stage scaled to
+// fit this box. ThumbHash is defined on images no larger than 100x100, and
+// BlurHash gains nothing from more pixels: both keep only a handful of
+// low-frequency DCT terms.
+const placeholderBox = 100
+
+// placeholderSource scales the smallest stage down for the hash encoders.
+// The result is pooled; the caller releases it.
+func placeholderSource(src *image.RGBA) *image.RGBA {
+	b := src.Bounds()
+	size := smartDims(ImageSize{b.Dx(), b.Dy()}, ImageSize{placeholderBox, placeholderBox})
+	return resizeTo(src, max(size.Width, 1), max(size.Height, 1))
+}
+
+// ---------------------------------------------------------------- BlurHash
+//
+// https://github.com/woltapp/blurhash/blob/master/Algorithm.md
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHash encodes img with xComp x yComp components (each 1-9). Callers use
+// 4x3 for landscape and 3x4 for portrait, the encoder's documented sweet spot.
+func blurHash(img *image.RGBA, xComp, yComp int) string {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+
+	// Precompute the linear-light pixels once; the factor loop visits every
+	// pixel xComp*yComp times.
+	lin := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y):]
+			lin[y*w+x] = [3]float64{srgbToLinear(p[0]), srgbToLinear(p[1]), srgbToLinear(p[2])}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComp*yComp)
+	for j := 0; j < yComp; j++ {
+		for i := 0; i < xComp; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				cy := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				for x := 0; x < w; x++ {
+					basis := norm * math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * cy
+					px := lin[y*w+x]
+					f[0] += basis * px[0]
+					f[1] += basis * px[1]
+					f[2] += basis * px[2]
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(base83((xComp-1)+(yComp-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maxAC := 1.0
+	if len(ac) > 0 {
+		actual := 0.0
+		for _, f := range ac {
+			actual = math.Max(actual, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quant := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maxAC = float64(quant+1) / 166
+		sb.WriteString(base83(quant, 1))
+	} else {
+		sb.WriteString(base83(0, 1))
+	}
+
+	dcValue := int(linearToSRGB(dc[0]))<<16 | int(linearToSRGB(dc[1]))<<8 | int(linearToSRGB(dc[2]))
+	sb.WriteString(base83(dcValue, 4))
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxAC, 0.5)*9+9.5))))
+		}
+		sb.WriteString(base83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2))
+	}
+	return sb.String()
+}
+
+func base83(value, length int) string {
+	out := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		out[i-1] = base83Chars[digit]
+	}
+	return string(out)
+}
+
+func srgbToLinear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) uint8 {
+	c := math.Max(0, math.Min(1, v))
+	if c <= 0.0031308 {
+		return uint8(c*12.92*255 + 0.5)
+	}
+	return uint8((1.055*math.Pow(c, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// ---------------------------------------------------------------- ThumbHash
+//
+// A port of rgbaToThumbHash from https://github.com/evanw/thumbhash. Our
+// stages are already flattened onto white, so the alpha channel is always
+// opaque, but the encoder handles it anyway to stay a faithful port.
+
+// thumbHash encodes an image no larger than 100x100 and returns the hash
+// bytes. The site receives them base64-encoded.
+func thumbHash(img *image.RGBA) []byte {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 || w > 100 || h > 100 {
+		return nil
+	}
+	n := w * h
+
+	// Average colour, weighted by alpha.
+	var avgR, avgG, avgB, avgA float64
+	px := func(i int) []uint8 {
+		return img.Pix[img.PixOffset(b.Min.X+i%w, b.Min.Y+i/w):]
+	}
+	for i := 0; i < n; i++ {
+		p := px(i)
+		alpha := float64(p[3]) / 255
+		avgR += alpha / 255 * float64(p[0])
+		avgG += alpha / 255 * float64(p[1])
+		avgB += alpha / 255 * float64(p[2])
+		avgA += alpha
+	}
+	if avgA > 0 {
+		avgR /= avgA
+		avgG /= avgA
+		avgB /= avgA
+	}
+
+	hasAlpha := avgA < float64(n)
+	lLimit := 7.0
+	if hasAlpha {
+		lLimit = 5 // fewer luminance bits when alpha needs the room
+	}
+	longest := float64(max(w, h))
+	lx := max(1, int(math.Round(lLimit*float64(w)/longest)))
+	ly := max(1, int(math.Round(lLimit*float64(h)/longest)))
+
+	// RGBA -> LPQA, composited over the average colour.
+	l := make([]float64, n)
+	p := make([]float64, n)
+	q := make([]float64, n)
+	a := make([]float64, n)
+	for i := 0; i < n; i++ {
+		c := px(i)
+		alpha := float64(c[3]) / 255
+		r := avgR*(1-alpha) + alpha/255*float64(c[0])
+		g := avgG*(1-alpha) + alpha/255*float64(c[1])
+		bl := avgB*(1-alpha) + alpha/255*float64(c[2])
+		l[i] = (r + g + bl) / 3
+		p[i] = (r+g)/2 - bl
+		q[i] = r - g
+		a[i] = alpha
+	}
+
+	encodeChannel := func(channel []float64, nx, ny int) (dc float64, ac []float64, scale float64) {
+		fx := make([]float64, w)
+		for cy := 0; cy < ny; cy++ {
+			for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+				for x := 0; x < w; x++ {
+					fx[x] = math.Cos(math.Pi / float64(w) * float64(cx) * (float64(x) + 0.5))
+				}
+				f := 0.0
+				for y := 0; y < h; y++ {
+					fy := math.Cos(math.Pi / float64(h) * float64(cy) * (float64(y) + 0.5))
+					for x := 0; x < w; x++ {
+						f += channel[x+y*w] * fx[x] * fy
+					}
+				}
+				f /= float64(n)
+				if cx > 0 || cy > 0 {
+					ac = append(ac, f)
+					scale = math.Max(scale, math.Abs(f))
+				} else {
+					dc = f
+				}
+			}
+		}
+		if scale > 0 {
+			for i := range ac {
+				ac[i] = 0.5 + 0.5/scale*ac[i]
+			}
+		}
+		return dc, ac, scale
+	}
+	lDC, lAC, lScale := encodeChannel(l, max(3, lx), max(3, ly))
+	pDC, pAC, pScale := encodeChannel(p, 3, 3)
+	qDC, qAC, qScale := encodeChannel(q, 3, 3)
+	var aDC, aScale float64
+	var aAC []float64
+	if hasAlpha {
+		aDC, aAC, aScale = encodeChannel(a, 5, 5)
+	}
+
+	round := func(f float64) int { return int(math.Round(f)) }
+	isLandscape := w > h
+	header24 := round(63*lDC) | round(31.5+31.5*pDC)<<6 | round(31.5+31.5*qDC)<<12 | round(31*lScale)<<18
+	if hasAlpha {
+		header24 |= 1 << 23
+	}
+	header16 := lx
+	if isLandscape {
+		header16 = ly
+	}
+	header16 |= round(63*pScale)<<3 | round(63*qScale)<<9
+	if isLandscape {
+		header16 |= 1 << 15
+	}
+
+	hash := []byte{
+		byte(header24), byte(header24 >> 8), byte(header24 >> 16),
+		byte(header16), byte(header16 >> 8),
+	}
+	acStart := 5
+	if hasAlpha {
+		hash = append(hash, byte(round(15*aDC)|round(15*aScale)<<4))
+		acStart = 6
+	}
+
+	channels := [][]float64{lAC, pAC, qAC}
+	if hasAlpha {
+		channels = append(channels, aAC)
+	}
+	acIndex := 0
+	for _, ac := range channels {
+		for _, f := range ac {
+			i := acStart + acIndex>>1
+			for len(hash) <= i {
+				hash = append(hash, 0)
+			}
+			hash[i] |= byte(round(15*f) << ((acIndex & 1) << 2))
+			acIndex++
+		}
+	}
+	return hash
+}
+
+// ---------------------------------------------------------------- LQIP
+
+// The low-quality image placeholder is a real, tiny image meant to be inlined
+// as a data URI and blurred with CSS. It is not uploaded as a file: fetching
+// it separately would cost the very request inlining exists to avoid.
+const (
+	lqipSize    = 24 // longest side, px
+	lqipQuality = 30
+)
+
+// lqip encodes a tiny copy of the smallest stage and returns it as a data URI.
+// It is WebP when WebP is among the output formats (it is roughly half the
+// size), and JPEG otherwise, so it never uses a format the site has not opted
+// into.
+func lqip(smallest *image.RGBA, formats []ImageFormat) (string, error) {
+	format := FormatJPEG
+	if slices.Contains(formats, FormatWEBP) {
+		format = FormatWEBP
+	}
+	b := smallest.Bounds()
+	size := smartDims(ImageSize{b.Dx(), b.Dy()}, ImageSize{lqipSize, lqipSize})
+	tiny := resizeTo(smallest, max(size.Width, 1), max(size.Height, 1))
+	defer releaseImage(tiny)
+
+	data, err := encode(tiny, format, lqipQuality)
+	if err != nil {
+		return "", err
+	}
+	return "data:" + format.ContentType() + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// placeholders fills in the BlurHash, ThumbHash, LQIP and palette for the
+// smallest stage. The palette shares the hashes' downsized copy.
+func (a *Analysis) placeholders(smallest *image.RGBA, formats []ImageFormat) error {
+	src := placeholderSource(smallest)
+	defer releaseImage(src)
+
+	xComp, yComp := 4, 3
+	if src.Bounds().Dy() > src.Bounds().Dx() {
+		xComp, yComp = 3, 4
+	}
+	a.BlurHash = blurHash(src, xComp, yComp)
+	a.ThumbHash = base64.StdEncoding.EncodeToString(thumbHash(src))
+	if a.Palette = extractPalette(src); len(a.Palette) > 0 {
+		a.Dominant = a.Palette[0]
+	}
+
+	var err error
+	if a.LQIP, err = lqip(smallest, formats); err != nil {
+		return fmt.Errorf("lqip: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// decodeBlurHash is the reference decoder, kept here because only the tests
+// need to turn a hash back into pixels.
+func decodeBlurHash(t *testing.T, hash string, w, h int) *image.RGBA {
+	t.Helper()
+	decode83 := func(s string) int {
+		v := 0
+		for _, c := range s {
+			i := strings.IndexRune(base83Chars, c)
+			if i < 0 {
+				t.Fatalf("invalid base83 character %q in %q", c, hash)
+			}
+			v = v*83 + i
+		}
+		return v
+	}
+	if len(hash) < 6 {
+		t.Fatalf("blurhash %q too short", hash)
+	}
+	size := decode83(hash[:1])
+	nx, ny := size%9+1, size/9+1
+	if len(hash) != 4+2*nx*ny {
+		t.Fatalf("blurhash %q has length %d, want %d for %dx%d", hash, len(hash), 4+2*nx*ny, nx, ny)
+	}
+	maxAC := float64(decode83(hash[1:2])+1) / 166
+
+	colors := make([][3]float64, nx*ny)
+	dc := decode83(hash[2:6])
+	colors[0] = [3]float64{srgbToLinear(uint8(dc >> 16)), srgbToLinear(uint8(dc >> 8)), srgbToLinear(uint8(dc))}
+	for i := 1; i < nx*ny; i++ {
+		v := decode83(hash[4+2*i : 6+2*i])
+		q := [3]int{v / (19 * 19), (v / 19) % 19, v % 19}
+		for c := 0; c < 3; c++ {
+			colors[i][c] = signPow(float64(q[c]-9)/9, 2) * maxAC
+		}
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var px [3]float64
+			for j := 0; j < ny; j++ {
+				for i := 0; i < nx; i++ {
+					basis := math.Cos(math.Pi*float64(x)*float64(i)/float64(w)) *
+						math.Cos(math.Pi*float64(y)*float64(j)/float64(h))
+					for c := 0; c < 3; c++ {
+						px[c] += colors[i+j*nx][c] * basis
+					}
+				}
+			}
+			out.SetRGBA(x, y, color.RGBA{linearToSRGB(px[0]), linearToSRGB(px[1]), linearToSRGB(px[2]), 255})
+		}
+	}
+	return out
+}
+
+// thumbHashAverage is thumbHashToAverageRGBA from the reference
+// implementation: the DC terms, converted back from LPQ to RGB (0-1).
+func thumbHashAverage(hash []byte) [3]float64 {
+	header := int(hash[0]) | int(hash[1])<<8 | int(hash[2])<<16
+	l := float64(header&63) / 63
+	p := float64((header>>6)&63)/31.5 - 1
+	q := float64((header>>12)&63)/31.5 - 1
+	b := l - 2.0/3*p
+	r := (3*l - b + q) / 2
+	g := r - q
+	clamp := func(v float64) float64 { return math.Max(0, math.Min(1, v)) }
+	return [3]float64{clamp(r), clamp(g), clamp(b)}
+}
+
+// thumbHashAspect is thumbHashToApproximateAspectRatio from the reference.
+func thumbHashAspect(hash []byte) float64 {
+	hasAlpha := hash[2]&0x80 != 0
+	isLandscape := hash[4]&0x80 != 0
+	full := 7.0
+	if hasAlpha {
+		full = 5
+	}
+	if isLandscape {
+		return full / float64(hash[3]&7)
+	}
+	return float64(hash[3]&7) / full
+}
+
+// meanColor averages an image's channels, in linear light or in sRGB (0-1).
+func meanColor(img *image.RGBA, linear bool) [3]float64 {
+	var sum [3]float64
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			for i, v := range []uint8{c.R, c.G, c.B} {
+				if linear {
+					sum[i] += srgbToLinear(v)
+				} else {
+					sum[i] += float64(v) / 255
+				}
+			}
+		}
+	}
+	n := float64(b.Dx() * b.Dy())
+	return [3]float64{sum[0] / n, sum[1] / n, sum[2] / n}
+}
+
+// placeholderFixture is two flat colours with a gradient between them, so the
+// average is well away from grey and the AC terms have something to encode.
+func placeholderFixture(w, h int) *image.RGBA {
+	m := synthImage(w, h)
+	draw.Draw(m, image.Rect(0, 0, w/3, h), image.NewUniform(color.RGBA{200, 40, 30, 255}), image.Point{}, draw.Src)
+	draw.Draw(m, image.Rect(2*w/3, 0, w, h), image.NewUniform(color.RGBA{20, 60, 180, 255}), image.Point{}, draw.Src)
+	return m
+}
+
+func TestBlurHashRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		w, h         int
+		xComp, yComp int
+	}{{"landscape", 100, 75, 4, 3}, {"portrait", 60, 100, 3, 4}, {"dc only", 40, 40, 1, 1}} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := placeholderFixture(tc.w, tc.h)
+			hash := blurHash(src, tc.xComp, tc.yComp)
+			if want := 4 + 2*tc.xComp*tc.yComp; len(hash) != want {
+				t.Fatalf("hash %q has length %d, want %d", hash, len(hash), want)
+			}
+			got := meanColor(decodeBlurHash(t, hash, 32, 32), true)
+			want := meanColor(src, true)
+			for c := 0; c < 3; c++ {
+				if math.Abs(got[c]-want[c]) > 0.03 {
+					t.Errorf("channel %d: decoded average %.3f, source %.3f (hash %q)", c, got[c], want[c], hash)
+				}
+			}
+		})
+	}
+}
+
+func TestThumbHashRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		w, h int
+	}{{"landscape", 100, 75}, {"portrait", 60, 100}, {"square", 50, 50}} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := placeholderFixture(tc.w, tc.h)
+			hash := thumbHash(src)
+			if len(hash) < 5 {
+				t.Fatalf("hash is %d bytes", len(hash))
+			}
+			got, want := thumbHashAverage(hash), meanColor(src, false)
+			for c := 0; c < 3; c++ {
+				if math.Abs(got[c]-want[c]) > 0.03 {
+					t.Errorf("channel %d: decoded average %.3f, source %.3f", c, got[c], want[c])
+				}
+			}
+			if got, want := thumbHashAspect(hash), float64(tc.w)/float64(tc.h); math.Abs(got-want)/want > 0.25 {
+				t.Errorf("approximate aspect %.2f, source %.2f", got, want)
+			}
+		})
+	}
+	if thumbHash(synthImage(101, 50)) != nil {
+		t.Error("thumbHash accepted an image wider than 100px")
+	}
+}
+
+// TestMetaDerivative: the placeholders reach meta.json and orig.jpeg's
+// metadata, computed from a stage that fits the 100px box.
+func TestMetaDerivative(t *testing.T) {
+	_, analysis, err := processImage(context.Background(), placeholderFixture(1600, 1200), getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := metaDerivative(analysis)
+	if d.Filename() != "meta.json" || d.ContentType() != "application/json" {
+		t.Errorf("meta derivative is %s (%s)", d.Filename(), d.ContentType())
+	}
+	var got Analysis
+	if err := json.Unmarshal(d.Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.BlurHash == "" || got.BlurHash != analysis.BlurHash {
+		t.Errorf("blurhash %q, want %q", got.BlurHash, analysis.BlurHash)
+	}
+	raw, err := base64.StdEncoding.DecodeString(got.ThumbHash)
+	if err != nil || len(raw) < 5 {
+		t.Errorf("thumbhash %q does not decode: %v", got.ThumbHash, err)
+	}
+	if !strings.HasPrefix(got.LQIP, "data:image/webp;base64,") {
+		t.Errorf("meta.json lqip = %.40q, want a WebP data URI", got.LQIP)
+	}
+	if md := analysis.metadata(); md["nnr-blurhash"] != analysis.BlurHash || md["nnr-thumbhash"] != analysis.ThumbHash {
+		t.Errorf("metadata %v is missing the placeholders", md)
+	}
+}
+
+func TestLQIP(t *testing.T) {
+	src := placeholderFixture(310, 225)
+	for _, tc := range []struct {
+		formats []ImageFormat
+		want    string
+	}{
+		{getDefaultImageTypes(), "webp"},
+		{[]ImageFormat{FormatJPEG}, "jpeg"},
+		{[]ImageFormat{FormatPNG}, "jpeg"},
+	} {
+		uri, err := lqip(src, tc.formats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := "data:image/" + tc.want + ";base64,"
+		if !strings.HasPrefix(uri, prefix) {
+			t.Fatalf("formats %v: URI starts %.30q, want %q", tc.formats, uri, prefix)
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(uri, prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, format, err := image.Decode(bytes.NewReader(data))
+		if err != nil || format != tc.want {
+			t.Fatalf("decoding the LQIP: format %q, err %v", format, err)
+		}
+		if b := img.Bounds(); b.Dx() != lqipSize || b.Dy() > lqipSize {
+			t.Errorf("LQIP is %dx%d, want %d wide", b.Dx(), b.Dy(), lqipSize)
+		}
+		// Small enough to inline without thinking about it.
+		if len(uri) > 1500 {
+			t.Errorf("LQIP data URI is %d bytes", len(uri))
+		}
+	}
+}
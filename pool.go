@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"math/bits"
+	"sync"
+)
+
+// Pixel buffers are the dominant allocation: a 12 MP photo is a 48 MB *RGBA
+// after flatten, and every chain stage, pre-shrink and crop allocates another.
+// A warm Lambda container handles one record after another at much the same
+// sizes, so those buffers are kept here and handed back out instead of being
+// left for the GC.
+//
+// Two guards stop the pool turning into a leak. A single buffer larger than
+// maxPooledBuffer is never retained, so one giant upload does not pin its
+// canvas for the life of the container, and the pool as a whole never holds
+// more than poolLimit bytes of idle memory.
+const (
+	minPooledBuffer = 4 << 10
+	maxPooledBuffer = 96 << 20  // ~24 MP RGBA
+	poolLimit       = 256 << 20 // idle bytes across every size class
+)
+
+// pooling is switched off by BenchmarkProcessImage to measure the difference.
+var pooling = true
+
+// sizePool is a free list of byte slices bucketed by size class. It is a
+// mutex-guarded map rather than a set of sync.Pools because sync.Pool cannot
+// report how much it holds, and the ceiling needs an exact count.
+type sizePool struct {
+	mu    sync.Mutex
+	free  map[int][][]byte // size class -> idle buffers of at least that capacity
+	held  int              // total capacity of every idle buffer
+	limit int
+}
+
+var pixels = &sizePool{free: map[int][][]byte{}, limit: poolLimit}
+
+// get returns a slice of length n. Its contents are NOT zeroed.
+func (p *sizePool) get(n int) []byte {
+	if !pooling || n < minPooledBuffer || n > maxPooledBuffer {
+		return make([]byte, n)
+	}
+	class := classCeil(n)
+	p.mu.Lock()
+	if list := p.free[class]; len(list) > 0 {
+		buf := list[len(list)-1]
+		list[len(list)-1] = nil
+		p.free[class] = list[:len(list)-1]
+		p.held -= cap(buf)
+		p.mu.Unlock()
+		return buf[:n]
+	}
+	p.mu.Unlock()
+	return make([]byte, n, class)
+}
+
+// put offers buf back to the pool. Buffers outside the pooled range, or that
+// would take the pool over its limit, are dropped for the GC to collect.
+func (p *sizePool) put(buf []byte) {
+	c := cap(buf)
+	if !pooling || c < minPooledBuffer || c > maxPooledBuffer {
+		return
+	}
+	class := classFloor(c)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.held+c > p.limit {
+		return
+	}
+	p.free[class] = append(p.free[class], buf[:0])
+	p.held += c
+}
+
+// classCeil rounds n up to its size class. Classes are quarter steps between
+// powers of two, so a pooled buffer wastes at most 25% rather than the 100% a
+// plain power-of-two scheme would cost on a 48 MB canvas.
+func classCeil(n int) int {
+	if n <= minPooledBuffer {
+		return minPooledBuffer
+	}
+	k := bits.Len(uint(n-1)) - 1 // 1<<k < n <= 1<<(k+1)
+	step := 1 << (k - 2)
+	base := 1 << k
+	return base + (n-base+step-1)/step*step
+}
+
+// classFloor rounds a capacity down to its size class, so every buffer filed
+// under a class is at least that large. It also accepts buffers the pool did
+// not allocate, such as a decoder's output.
+func classFloor(c int) int {
+	k := bits.Len(uint(c)) - 1 // 1<<k <= c
+	step := 1 << (k - 2)
+	base := 1 << k
+	return base + (c-base)/step*step
+}
+
+// newRGBA is image.NewRGBA backed by the pool. The pixels are NOT zeroed:
+// callers must overwrite every one, which all of ours do with draw.Src or a
+// full copy.
+func newRGBA(r image.Rectangle) *image.RGBA {
+	w, h := r.Dx(), r.Dy()
+	if w <= 0 || h <= 0 {
+		return image.NewRGBA(r)
+	}
+	return &image.RGBA{Pix: pixels.get(4 * w * h), Stride: 4 * w, Rect: r}
+}
+
+// releaseImage returns an image's pixels to the pool. The caller must not use
+// img afterwards. Anything that is not a whole *image.RGBA (a SubImage shares
+// its parent's buffer) is ignored.
+func releaseImage(img image.Image) {
+	m, ok := img.(*image.RGBA)
+	if !ok || m == nil {
+		return
+	}
+	if m.Stride != 4*m.Rect.Dx() || len(m.Pix) != m.Stride*m.Rect.Dy() {
+		return
+	}
+	pixels.put(m.Pix)
+}
+
+// buffers holds the bytes.Buffers encode renders into. Encoded output is far
+// smaller than the pixels, so a sync.Pool (emptied by the GC) is enough; the
+// size check still stops an oversized PNG from being kept.
+var buffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func getBuffer() *bytes.Buffer {
+	if !pooling {
+		return new(bytes.Buffer)
+	}
+	buf := buffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if !pooling || buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buffers.Put(buf)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+// TestSizeClasses: a class handed out must fit the request, and a buffer filed
+// under a class must be at least that large, or a reused canvas would be short.
+func TestSizeClasses(t *testing.T) {
+	for _, n := range []int{1, 4096, 4097, 5000, 8191, 8192, 1 << 20, 3_000_001, 48_000_000, maxPooledBuffer} {
+		c := classCeil(n)
+		if c < n {
+			t.Errorf("classCeil(%d) = %d, smaller than the request", n, c)
+		}
+		if n > minPooledBuffer && float64(c) > float64(n)*1.25+1 {
+			t.Errorf("classCeil(%d) = %d, wastes more than 25%%", n, c)
+		}
+		if classFloor(c) != c {
+			t.Errorf("classFloor(classCeil(%d)) = %d, want %d", n, classFloor(c), c)
+		}
+		if n >= minPooledBuffer && classFloor(n) > n {
+			t.Errorf("classFloor(%d) = %d, larger than the buffer", n, classFloor(n))
+		}
+	}
+}
+
+func TestPoolReusesBuffers(t *testing.T) {
+	p := &sizePool{free: map[int][][]byte{}, limit: poolLimit}
+	a := p.get(100_000)
+	a[0] = 42
+	p.put(a)
+	b := p.get(99_000)
+	if len(b) != 99_000 {
+		t.Fatalf("len = %d, want 99000", len(b))
+	}
+	if &a[0] != &b[0] {
+		t.Error("a same-class request did not reuse the pooled buffer")
+	}
+	if p.held != 0 {
+		t.Errorf("held = %d after taking the only buffer, want 0", p.held)
+	}
+}
+
+// TestPoolCeiling: the pool must never pin more than its limit, and must never
+// keep a buffer above maxPooledBuffer no matter how much room is left.
+func TestPoolCeiling(t *testing.T) {
+	p := &sizePool{free: map[int][][]byte{}, limit: 1 << 20}
+	for i := 0; i < 10; i++ {
+		p.put(make([]byte, 300_000))
+	}
+	if p.held > p.limit {
+		t.Errorf("held %d bytes, limit is %d", p.held, p.limit)
+	}
+
+	big := &sizePool{free: map[int][][]byte{}, limit: poolLimit}
+	big.put(make([]byte, 0, maxPooledBuffer+1))
+	if big.held != 0 {
+		t.Errorf("an oversized buffer was retained (%d bytes held)", big.held)
+	}
+}
+
+func TestReleaseImageIgnoresSubImages(t *testing.T) {
+	before := pixels.held
+	m := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	releaseImage(m.SubImage(image.Rect(8, 8, 16, 16)))
+	if pixels.held != before {
+		t.Error("a SubImage was pooled; it shares its parent's pixels")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"image"
 )
@@ -17,61 +18,81 @@ import (
 //  1. decode once (done by the caller) and flatten any alpha onto white
 //  2. encode orig.jpeg at the original dimensions
 //  3. walk the breakpoints largest-first, feeding each resize into the next
-//  4. centre-crop a square thumbnail
+//  4. measure the smallest stage (see Analysis)
+//  5. centre-crop a square thumbnail
 //
 // Chaining is both faster and higher quality than the previous code, which
 // re-decoded orig.jpeg for every derivative and so stacked a fresh generation
 // of JPEG loss onto each one. Here the chain runs on raw pixels.
+//
+// Before each stage it checks that enough of ctx's deadline is left to finish
+// and upload the set, and otherwise returns an ErrDeadline.
 func processImage(
+	ctx context.Context,
 	src image.Image,
 	formats []ImageFormat,
 	dims map[string]ImageSize,
 	thumbSize int,
-) ([]Derivative, error) {
+) ([]Derivative, Analysis, error) {
+	var analysis Analysis
 	if len(formats) == 0 {
-		return nil, fmt.Errorf("no output formats requested")
+		return nil, analysis, fmt.Errorf("no output formats requested")
 	}
 	if len(dims) == 0 {
-		return nil, fmt.Errorf("no output dimensions requested")
+		return nil, analysis, fmt.Errorf("no output dimensions requested")
 	}
 
 	// One flatten for the whole run. Every derivative descends from this, just
 	// as every derivative used to descend from orig.jpeg.
 	base := flatten(src)
+	// Every intermediate below is owned by this call and goes back to the
+	// pixel pool on the way out; only encoded bytes escape.
+	owned := []*image.RGBA{base}
+	defer func() {
+		for _, m := range owned {
+			releaseImage(m)
+		}
+	}()
 	origDims := ImageSize{Width: base.Bounds().Dx(), Height: base.Bounds().Dy()}
 	if origDims.Width == 0 || origDims.Height == 0 {
-		return nil, fmt.Errorf("image has zero dimension: %dx%d", origDims.Width, origDims.Height)
+		return nil, analysis, fmt.Errorf("image has zero dimension: %dx%d", origDims.Width, origDims.Height)
 	}
 
 	out := make([]Derivative, 0, len(dims)*len(formats)+2)
 
 	origData, err := encode(base, FormatJPEG, defaultQuality)
 	if err != nil {
-		return nil, fmt.Errorf("orig: %w", err)
+		return nil, analysis, fmt.Errorf("orig: %w", err)
 	}
-	out = append(out, Derivative{Name: "orig", Format: FormatJPEG, Data: origData})
+	out = append(out, Derivative{Name: "orig", Format: FormatJPEG, Data: origData,
+		Width: origDims.Width, Height: origDims.Height, Quality: defaultQuality})
 
 	// Descending order: each stage is the source for the next.
-	var cur image.Image = base
+	cur := base
 	curDims := origDims
 	var thumbSource image.Image = base
 
 	for _, ns := range sortedDims(dims) {
+		if err := checkDeadline(ctx, uploadReserve); err != nil {
+			return nil, analysis, fmt.Errorf("%s: %w", ns.Name, err)
+		}
 		// Computed against the ORIGINAL dimensions, not the current chain
 		// stage, so "never upscale" behaves exactly as it always has.
 		newDims := smartDims(origDims, ns.Box)
 
 		if newDims != curDims {
-			cur = resizeTo(cur, newDims.Width, newDims.Height)
-			curDims = newDims
+			stage := resizeTo(cur, newDims.Width, newDims.Height)
+			owned = append(owned, stage)
+			cur, curDims = stage, newDims
 		}
 
 		for _, format := range formats {
 			data, err := encode(cur, format, defaultQuality)
 			if err != nil {
-				return nil, fmt.Errorf("%s.%v: %w", ns.Name, format, err)
+				return nil, analysis, fmt.Errorf("%s.%v: %w", ns.Name, format, err)
 			}
-			out = append(out, Derivative{Name: ns.Name, Format: format, Data: data})
+			out = append(out, Derivative{Name: ns.Name, Format: format, Data: data,
+				Width: curDims.Width, Height: curDims.Height, Quality: defaultQuality})
 		}
 
 		// Crop the thumbnail from the smallest stage still comfortably larger
@@ -81,12 +102,26 @@ func processImage(
 		}
 	}
 
+	if err := checkDeadline(ctx, uploadReserve); err != nil {
+		return nil, analysis, fmt.Errorf("thumbnail: %w", err)
+	}
+
+	// The last stage is the smallest: analysis there costs next to nothing.
+	analysis.Width, analysis.Height = origDims.Width, origDims.Height
+	analysis.Quality = measureQuality(cur)
+	analysis.PHash = formatHash(perceptualHash(cur))
+	if err := analysis.placeholders(cur, formats); err != nil {
+		return nil, analysis, err
+	}
+
 	thumb := coverCrop(thumbSource, thumbSize)
+	owned = append(owned, thumb)
 	thumbData, err := encode(thumb, FormatJPEG, thumbnailQuality)
 	if err != nil {
-		return nil, fmt.Errorf("thumbnail: %w", err)
+		return nil, analysis, fmt.Errorf("thumbnail: %w", err)
 	}
-	out = append(out, Derivative{Name: "thumbnail", Format: FormatJPEG, Data: thumbData})
+	out = append(out, Derivative{Name: "thumbnail", Format: FormatJPEG, Data: thumbData,
+		Width: thumb.Bounds().Dx(), Height: thumb.Bounds().Dy(), Quality: thumbnailQuality})
 
-	return out, nil
+	return out, analysis, nil
 }
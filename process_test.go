@@ -2,6 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"image"
 	"image/color"
 	"image/jpeg"
@@ -40,7 +44,7 @@ func decodeDerivative(t *testing.T, d Derivative) (image.Image, string) {
 // with the Django app (recipes.models.SCREEN_SIZES x PHOTO_EXTENSIONS plus
 // orig.jpeg and thumbnail.jpeg).
 func TestProcessImageManifest(t *testing.T) {
-	derivatives, err := processImage(synthImage(1600, 1200), getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
+	derivatives, _, err := processImage(context.Background(), synthImage(1600, 1200), getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -74,7 +78,7 @@ func TestProcessImageManifest(t *testing.T) {
 func TestProcessImageDimensions(t *testing.T) {
 	const w, h = 1600, 1200
 	dims := getDefaultDims()
-	derivatives, err := processImage(synthImage(w, h), getDefaultImageTypes(), dims, defaultThumbSize)
+	derivatives, _, err := processImage(context.Background(), synthImage(w, h), getDefaultImageTypes(), dims, defaultThumbSize)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -104,7 +108,7 @@ func TestProcessImageDimensions(t *testing.T) {
 // TestProcessImageFormats verifies the bytes really are the format the filename
 // claims, by sniffing rather than trusting the extension.
 func TestProcessImageFormats(t *testing.T) {
-	derivatives, err := processImage(synthImage(800, 600), getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
+	derivatives, _, err := processImage(context.Background(), synthImage(800, 600), getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -130,7 +134,7 @@ func TestProcessImageFormats(t *testing.T) {
 // size at every breakpoint.
 func TestProcessImageNeverUpscales(t *testing.T) {
 	const w, h = 200, 150
-	derivatives, err := processImage(synthImage(w, h), []ImageFormat{FormatJPEG}, getDefaultDims(), 64)
+	derivatives, _, err := processImage(context.Background(), synthImage(w, h), []ImageFormat{FormatJPEG}, getDefaultDims(), 64)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -195,6 +199,32 @@ func TestCoverCropGeometry(t *testing.T) {
 	}
 }
 
+// TestCoverBoxGeometry: the box is filled exactly, and a source too small for
+// it keeps the box's proportions at its own size.
+func TestCoverBoxGeometry(t *testing.T) {
+	tests := []struct {
+		name         string
+		w, h         int
+		boxW, boxH   int
+		wantW, wantH int
+	}{
+		{"landscape into wide", 1200, 800, 400, 200, 400, 200},
+		{"landscape into tall", 1200, 800, 200, 400, 200, 400},
+		{"portrait into square", 600, 900, 300, 300, 300, 300},
+		{"too small", 300, 200, 800, 400, 300, 150},
+		{"exact", 400, 300, 400, 300, 400, 300},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := coverBox(synthImage(tc.w, tc.h), tc.boxW, tc.boxH)
+			if got.Bounds().Dx() != tc.wantW || got.Bounds().Dy() != tc.wantH {
+				t.Errorf("coverBox(%dx%d, %dx%d) = %dx%d, want %dx%d", tc.w, tc.h, tc.boxW, tc.boxH,
+					got.Bounds().Dx(), got.Bounds().Dy(), tc.wantW, tc.wantH)
+			}
+		})
+	}
+}
+
 // TestTransparentPNGFlattensToWhite pins the one deliberate behaviour change:
 // libvips dropped the alpha band and Go would premultiply it to black, so a
 // transparent region must be composited onto white instead.
@@ -210,7 +240,7 @@ func TestTransparentPNGFlattensToWhite(t *testing.T) {
 	if err := png.Encode(&buf, src); err != nil {
 		t.Fatal(err)
 	}
-	decoded, _, err := decodeImage(buf.Bytes())
+	decoded, _, err := decodeImage(buf.Bytes(), decodeLimits{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -230,10 +260,10 @@ func TestTransparentPNGFlattensToWhite(t *testing.T) {
 
 func TestProcessImageRejectsEmptyConfig(t *testing.T) {
 	src := synthImage(100, 100)
-	if _, err := processImage(src, nil, getDefaultDims(), 128); err == nil {
+	if _, _, err := processImage(context.Background(), src, nil, getDefaultDims(), 128); err == nil {
 		t.Error("expected an error with no formats")
 	}
-	if _, err := processImage(src, getDefaultImageTypes(), nil, 128); err == nil {
+	if _, _, err := processImage(context.Background(), src, getDefaultImageTypes(), nil, 128); err == nil {
 		t.Error("expected an error with no dims")
 	}
 }
@@ -251,11 +281,11 @@ func TestProcessRealHEIC(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			img, _, err := decodeImage(data)
+			img, _, err := decodeImage(data, decodeLimits{})
 			if err != nil {
 				t.Fatal(err)
 			}
-			derivatives, err := processImage(img, getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
+			derivatives, _, err := processImage(context.Background(), img, getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -272,7 +302,7 @@ func TestProcessRealHEIC(t *testing.T) {
 }
 
 // TestOversizedInputRejected uses a hand-built PNG header claiming a canvas
-// beyond maxPixels, so nothing large is ever allocated.
+// beyond the pixel limit, so nothing large is ever allocated.
 func TestOversizedInputRejected(t *testing.T) {
 	var buf bytes.Buffer
 	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
@@ -284,8 +314,11 @@ func TestOversizedInputRejected(t *testing.T) {
 		data[16+i] = v
 		data[20+i] = v
 	}
-	if _, _, err := decodeImage(data); err == nil {
-		t.Error("a 65536x65536 image was accepted, want rejection")
+	// Fix up the IHDR CRC (over type+data, bytes 12-28), or the decoder
+	// rejects the header before any limit is consulted.
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	if _, _, err := decodeImage(data, decodeLimits{}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("a 65536x65536 image: err = %v, want ErrTooLarge", err)
 	}
 }
 
@@ -299,3 +332,26 @@ func TestJPEGQualityConstantsMatchLegacy(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// BenchmarkProcessImage runs the full pipeline back to back, the way a warm
+// Lambda container does, with and without the pixel and buffer pools:
+//
+//	go test -tags nodynamic -run '^$' -bench ProcessImage -benchmem
+func BenchmarkProcessImage(b *testing.B) {
+	src := synthImage(3000, 2000)
+	for _, tc := range []struct {
+		name    string
+		pooling bool
+	}{{"fresh", false}, {"pooled", true}} {
+		b.Run(tc.name, func(b *testing.B) {
+			defer func(prev bool) { pooling = prev }(pooling)
+			pooling = tc.pooling
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := processImage(context.Background(), src, getDefaultImageTypes(), getDefaultDims(), defaultThumbSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
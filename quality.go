@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+)
+
+// histogramBins is the resolution of the exposure histogram. Sixteen bins is
+// enough to see a crushed or blown-out photo at a glance and keeps the
+// metadata small.
+const histogramBins = 16
+
+// Luma thresholds for the clipped-pixel fractions.
+const (
+	shadowLuma    = 16
+	highlightLuma = 240
+)
+
+// QualityScores describe how usable a photo looks. They are measured on the
+// smallest chain stage, so they are cheap and, for a given DIMENSIONS,
+// comparable across uploads larger than the smallest box. Nothing is
+// upscaled, so an upload that already fits inside that box is scored at its
+// own resolution instead. Sharpness in particular is scale dependent: compare
+// it only against scores from the same configuration, and expect small
+// uploads to score differently.
+type QualityScores struct {
+	// Sharpness is the variance of the Laplacian of the luma. An out-of-focus
+	// photo has few edges and scores low.
+	Sharpness float64 `json:"sharpness"`
+	// Brightness is the mean luma, 0-255.
+	Brightness float64 `json:"brightness"`
+	// Shadows and Highlights are the fractions of pixels that are clipped
+	// black (luma <= 16) or white (luma >= 240).
+	Shadows    float64 `json:"shadows"`
+	Highlights float64 `json:"highlights"`
+	// Histogram is the luma distribution in 16 equal bins, as fractions.
+	Histogram []float64 `json:"histogram"`
+}
+
+// measureQuality computes the scores for img. It reads Pix directly: every
+// chain stage is an *image.RGBA, and At() would dominate the cost.
+func measureQuality(img *image.RGBA) QualityScores {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	q := QualityScores{Histogram: make([]float64, histogramBins)}
+	if w == 0 || h == 0 {
+		return q
+	}
+
+	luma := make([]float64, w*h)
+	var sum float64
+	var shadows, highlights int
+	counts := make([]int, histogramBins)
+	for y := 0; y < h; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < w; x++ {
+			p := row[x*4:]
+			// ITU-R BT.601, as JPEG uses.
+			l := 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+			luma[y*w+x] = l
+			sum += l
+			switch {
+			case l <= shadowLuma:
+				shadows++
+			case l >= highlightLuma:
+				highlights++
+			}
+			counts[min(int(l)*histogramBins/256, histogramBins-1)]++
+		}
+	}
+	n := float64(w * h)
+	q.Brightness = roundTo(sum/n, 2)
+	q.Shadows = roundTo(float64(shadows)/n, 4)
+	q.Highlights = roundTo(float64(highlights)/n, 4)
+	for i, c := range counts {
+		q.Histogram[i] = roundTo(float64(c)/n, 4)
+	}
+
+	// 4-neighbour Laplacian over the interior. Anything smaller than 3x3 has
+	// no interior and is reported as 0.
+	if w < 3 || h < 3 {
+		return q
+	}
+	var lsum, lsq float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			v := luma[i-w] + luma[i+w] + luma[i-1] + luma[i+1] - 4*luma[i]
+			lsum += v
+			lsq += v * v
+		}
+	}
+	m := float64((w - 2) * (h - 2))
+	mean := lsum / m
+	q.Sharpness = roundTo(lsq/m-mean*mean, 2)
+	return q
+}
+
+// metadata renders the headline scores as S3 user metadata. The histogram is
+// left out: it is too long to be useful in a header.
+func (q QualityScores) metadata() map[string]string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	return map[string]string{
+		"nnr-sharpness":  f(q.Sharpness),
+		"nnr-brightness": f(q.Brightness),
+		"nnr-shadows":    f(q.Shadows),
+		"nnr-highlights": f(q.Highlights),
+	}
+}
+
+// checkQuality returns a Rejection if the scores fall below the configured
+// minimum sharpness, or nil. A zero minimum disables the gate.
+func checkQuality(q QualityScores, rules acceptRules, source string, size ImageSize) *Rejection {
+	if rules.minSharpness <= 0 || q.Sharpness >= rules.minSharpness {
+		return nil
+	}
+	return &Rejection{
+		Source:       source,
+		Reason:       "blurry",
+		Message:      fmt.Sprintf("sharpness %.2f is below the minimum %.2f", q.Sharpness, rules.minSharpness),
+		Width:        size.Width,
+		Height:       size.Height,
+		Sharpness:    q.Sharpness,
+		MinSharpness: rules.minSharpness,
+	}
+}
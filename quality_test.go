@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// checkerboard is a worst case for blur: all of its detail is hard edges.
+func checkerboard(w, h, cell int) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{30, 30, 30, 255}
+			if (x/cell+y/cell)%2 == 0 {
+				c = color.RGBA{220, 220, 220, 255}
+			}
+			m.SetRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+// blur simulates an out-of-focus shot by throwing away detail and scaling
+// back up.
+func blur(src *image.RGBA, factor int) *image.RGBA {
+	b := src.Bounds()
+	small := image.NewRGBA(image.Rect(0, 0, b.Dx()/factor, b.Dy()/factor))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), src, b, draw.Src, nil)
+	out := image.NewRGBA(b)
+	draw.BiLinear.Scale(out, b, small, small.Bounds(), draw.Src, nil)
+	return out
+}
+
+func TestSharpnessDetectsBlur(t *testing.T) {
+	sharp := checkerboard(320, 240, 8)
+	soft := blur(sharp, 8)
+	qs, qb := measureQuality(sharp), measureQuality(soft)
+	if qb.Sharpness*10 > qs.Sharpness {
+		t.Errorf("blurred sharpness %.1f is not well below the original %.1f", qb.Sharpness, qs.Sharpness)
+	}
+	if flat := measureQuality(image.NewRGBA(image.Rect(0, 0, 64, 64))); flat.Sharpness != 0 {
+		t.Errorf("a flat image has sharpness %.2f, want 0", flat.Sharpness)
+	}
+}
+
+func TestExposureScores(t *testing.T) {
+	fill := func(c color.RGBA) *image.RGBA {
+		m := image.NewRGBA(image.Rect(0, 0, 40, 30))
+		draw.Draw(m, m.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		return m
+	}
+	black := measureQuality(fill(color.RGBA{0, 0, 0, 255}))
+	if black.Shadows != 1 || black.Highlights != 0 || black.Brightness != 0 {
+		t.Errorf("black: %+v", black)
+	}
+	white := measureQuality(fill(color.RGBA{255, 255, 255, 255}))
+	if white.Highlights != 1 || white.Shadows != 0 || white.Histogram[histogramBins-1] != 1 {
+		t.Errorf("white: %+v", white)
+	}
+
+	q := measureQuality(synthImage(300, 200))
+	var total float64
+	for _, f := range q.Histogram {
+		total += f
+	}
+	if math.Abs(total-1) > 0.01 {
+		t.Errorf("histogram sums to %.4f, want 1", total)
+	}
+}
+
+func TestCheckQuality(t *testing.T) {
+	q := QualityScores{Sharpness: 42}
+	size := ImageSize{1600, 1200}
+	if rej := checkQuality(q, acceptRules{}, "a/b.jpg", size); rej != nil {
+		t.Errorf("no threshold configured, got %v", rej)
+	}
+	if rej := checkQuality(q, acceptRules{minSharpness: 40}, "a/b.jpg", size); rej != nil {
+		t.Errorf("above threshold, got %v", rej)
+	}
+	rej := checkQuality(q, acceptRules{minSharpness: 50}, "a/b.jpg", size)
+	if rej == nil || rej.Reason != "blurry" || rej.Sharpness != 42 || rej.Width != 1600 {
+		t.Errorf("below threshold, got %+v", rej)
+	}
+}
+
+// TestProcessImageAnalysis: the scores come from the smallest stage, but the
+// reported dimensions are the original's.
+func TestProcessImageAnalysis(t *testing.T) {
+	_, analysis, err := processImage(context.Background(), checkerboard(1600, 1200, 16), getDefaultImageTypes(), getDefaultDims(), defaultThumbSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if analysis.Width != 1600 || analysis.Height != 1200 {
+		t.Errorf("analysis is %dx%d, want 1600x1200", analysis.Width, analysis.Height)
+	}
+	if analysis.Quality.Sharpness == 0 || len(analysis.Quality.Histogram) != histogramBins {
+		t.Errorf("quality not measured: %+v", analysis.Quality)
+	}
+}
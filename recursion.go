@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// generatedMetadata marks every file this program writes, as the user
+// metadata x-amz-meta-nnr-photos-generated. A source carrying it is one of
+// our own outputs, reached through a notification that should not exist.
+const generatedMetadata = "nnr-photos-generated"
+
+// errRecursion refuses a record in the destination bucket that could be one
+// of our own outputs. runRecord skips such a record with a warning.
+var errRecursion = errors.New("source is in the destination bucket")
+
+// withGeneratedMarker returns metadata plus the generated marker, leaving
+// metadata itself untouched.
+func withGeneratedMarker(metadata map[string]string) map[string]string {
+	m := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		m[k] = v
+	}
+	m[generatedMetadata] = "true"
+	return m
+}
+
+// guardRecursion stops a run that would feed on its own outputs. A source in
+// the destination bucket is only processed when OUTPUT_PREFIX says where the
+// outputs go and the source is outside it. It returns whether the record is
+// an output to ignore, or errRecursion when the configuration cannot tell.
+func guardRecursion(cfg settings, record objectRecord) (bool, error) {
+	if record.Bucket == "" || record.Bucket != cfg.destinationBucket {
+		return false, nil
+	}
+	if cfg.outputPrefix == "" {
+		return false, fmt.Errorf("%w %s and OUTPUT_PREFIX is not set, so every output would be processed again",
+			errRecursion, cfg.destinationBucket)
+	}
+	return strings.HasPrefix(record.Key, cfg.outputPrefix+"/"), nil
+}
+
+// checkOutputPrefix makes sure every key the template produces is under
+// prefix, or the guard would wave our own outputs through as sources.
+func checkOutputPrefix(keys keyTemplate, prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("OUTPUT_PREFIX %q must not start or end with /", prefix)
+	}
+	if !keys.withDefault().under(prefix) {
+		return fmt.Errorf("OUTPUT_PREFIX %q: the key template %q writes outside it; start KEY_TEMPLATE with %q",
+			prefix, keys.withDefault().raw, prefix+"/")
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGuardRecursion(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		prefix     string
+		rec        objectRecord
+		wantOutput bool
+		wantErr    bool
+	}{
+		{"other bucket", "", objectRecord{Bucket: "src", Key: "tags/bread/orig.jpg"}, false, false},
+		{"http upload", "", objectRecord{Key: "tags/bread/orig.jpg"}, false, false},
+		{"same bucket, no prefix", "", objectRecord{Bucket: "dest", Key: "tags/bread/orig.jpg"}, false, true},
+		{"same bucket, outside prefix", "processed", objectRecord{Bucket: "dest", Key: "tags/bread/orig.jpg"}, false, false},
+		{"same bucket, inside prefix", "processed", objectRecord{Bucket: "dest", Key: "processed/tags/bread/400.webp"}, true, false},
+		{"same bucket, prefix lookalike", "processed", objectRecord{Bucket: "dest", Key: "processed-raw/bread.jpg"}, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := settings{destinationBucket: "dest", outputPrefix: tc.prefix}
+			output, err := guardRecursion(cfg, tc.rec)
+			if output != tc.wantOutput || (err != nil) != tc.wantErr {
+				t.Errorf("guardRecursion() = %v, %v, want %v, error %v", output, err, tc.wantOutput, tc.wantErr)
+			}
+			if err != nil && !errors.Is(err, errRecursion) {
+				t.Errorf("error %v is not errRecursion", err)
+			}
+		})
+	}
+}
+
+func TestCheckOutputPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		template, prefix string
+		wantErr          string
+	}{
+		{"", "", ""},
+		{"", "processed", "writes outside it"},
+		{"processed/{prefix}/{name}.{ext}", "processed", ""},
+		{"processed/renditions/{sourceStem}/{name}.{ext}", "processed", ""},
+		{"processed{prefix}/{name}.{ext}", "processed", "writes outside it"},
+		{"processed/{prefix}/{name}.{ext}", "processed/", "start or end"},
+	} {
+		var keys keyTemplate
+		if tc.template != "" {
+			keys = mustKeyTemplate(t, tc.template)
+		}
+		err := checkOutputPrefix(keys, tc.prefix)
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("checkOutputPrefix(%q, %q) = %v, want %q", tc.template, tc.prefix, err, tc.wantErr)
+		}
+	}
+}
+
+// TestHandleRecordIgnoresOwnOutputs: every upload carries the generated
+// marker, and a record for one of them uploads nothing.
+func TestHandleRecordIgnoresOwnOutputs(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{"tags/bread/orig.png": testPNG(t, 800, 600)}}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64}
+	if err := handleRecord(context.Background(), fake, cfg, objectRecord{Bucket: "src", Key: "tags/bread/orig.png"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range fake.puts {
+		if p.Metadata[generatedMetadata] != "true" {
+			t.Errorf("%s has no generated marker: %v", *p.Key, p.Metadata)
+		}
+	}
+
+	// Another notification feeds the derivatives back, under another bucket
+	// name so only the marker can tell.
+	puts := len(fake.puts)
+	status, err := runRecord(context.Background(), fake, cfg, objectRecord{Bucket: "mirror", Key: "tags/bread/400.webp"})
+	if err != nil || status != statusSkipped || len(fake.puts) != puts {
+		t.Errorf("own output: %s, %v after %d uploads, want skipped and none", status, err, len(fake.puts)-puts)
+	}
+}
+
+// TestHandleRecordSameBucket: with OUTPUT_PREFIX a bucket can hold both the
+// uploads and the sets; without it, its records are skipped.
+func TestHandleRecordSameBucket(t *testing.T) {
+	img := testPNG(t, 800, 600)
+	cfg := settings{destinationBucket: "media", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64}
+
+	fake := &fakeS3{objects: map[string][]byte{"tags/bread/orig.png": img}}
+	status, err := runRecord(context.Background(), fake, cfg, objectRecord{Bucket: "media", Key: "tags/bread/orig.png"})
+	if err != nil || status != statusSkipped || len(fake.puts) != 0 {
+		t.Errorf("without OUTPUT_PREFIX: %s, %v, %d uploads, want skipped and none", status, err, len(fake.puts))
+	}
+
+	cfg.outputPrefix = "processed"
+	cfg.keys = mustKeyTemplate(t, "processed/{prefix}/{name}.{ext}")
+	if err := handleRecord(context.Background(), fake, cfg, objectRecord{Bucket: "media", Key: "tags/bread/orig.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.bodies["processed/tags/bread/manifest.json"] == nil {
+		t.Fatal("the set was not written under OUTPUT_PREFIX")
+	}
+	puts := len(fake.puts)
+	status, err = runRecord(context.Background(), fake, cfg, objectRecord{Bucket: "media", Key: "processed/tags/bread/400.webp"})
+	if err != nil || status != statusSkipped || len(fake.puts) != puts {
+		t.Errorf("output under the prefix: %s, %v, want skipped", status, err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ReprocessRequest is the payload for regenerating sets on demand, without
+// faking S3 events:
+//
+//	{"action": "reprocess", "bucket": "nnr-media-raw",
+//	 "keys": ["media/images/tags/bread/orig.jpg"],
+//	 "overrides": {"dims": "1200:1090,818;768:670,503", "formats": "jpeg,webp"}}
+//
+// Keys are plain, not URL-encoded. Overrides use the DIMENSIONS and FORMATS
+// syntax and replace those settings for this invocation only; an empty one
+// keeps the function's setting.
+type ReprocessRequest struct {
+	Action    string             `json:"action"`
+	Bucket    string             `json:"bucket"`
+	Keys      []string           `json:"keys"`
+	Overrides ReprocessOverrides `json:"overrides"`
+}
+
+// ReprocessOverrides replaces settings for one reprocess request.
+type ReprocessOverrides struct {
+	Dims    string `json:"dims,omitempty"`
+	Formats string `json:"formats,omitempty"`
+}
+
+const actionReprocess = "reprocess"
+
+// parseReprocessRequest reads a request strictly: a misspelt override would
+// otherwise be ignored, and the whole list regenerated with the old settings.
+func parseReprocessRequest(payload []byte) (ReprocessRequest, error) {
+	var req ReprocessRequest
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return req, fmt.Errorf("reading reprocess request: %w", err)
+	}
+	return req, nil
+}
+
+// apply validates the request and returns cfg with its overrides. It runs
+// before anything is downloaded, so a bad request does no work at all.
+// Reprocessing forces: the sources are unchanged by definition.
+func (r ReprocessRequest) apply(cfg settings) (settings, error) {
+	if r.Action != actionReprocess {
+		return cfg, fmt.Errorf("unknown action %q", r.Action)
+	}
+	if r.Bucket == "" {
+		return cfg, errors.New("reprocess: no bucket")
+	}
+	if len(r.Keys) == 0 {
+		return cfg, errors.New("reprocess: no keys")
+	}
+	for _, k := range r.Keys {
+		if _, _, err := splitKey(k); err != nil {
+			return cfg, fmt.Errorf("reprocess: key %q: %w", k, err)
+		}
+	}
+	var err error
+	if r.Overrides.Dims != "" {
+		if cfg.dims, err = parseDims(r.Overrides.Dims); err != nil {
+			return cfg, fmt.Errorf("reprocess: overrides.dims: %w", err)
+		}
+	}
+	if r.Overrides.Formats != "" {
+		if cfg.formats, err = parseImageTypes(r.Overrides.Formats); err != nil {
+			return cfg, fmt.Errorf("reprocess: overrides.formats: %w", err)
+		}
+	}
+	cfg.force = true
+	return cfg, nil
+}
+
+// ReprocessHandler regenerates the sets for a list of source keys.
+func ReprocessHandler(ctx context.Context, req ReprocessRequest) (Summary, error) {
+	cfg, client, err := setup(ctx)
+	if err != nil {
+		return Summary{}, err
+	}
+	return handleReprocess(ctx, client, cfg, req)
+}
+
+func handleReprocess(ctx context.Context, client s3API, cfg settings, req ReprocessRequest) (Summary, error) {
+	cfg, err := req.apply(cfg)
+	if err != nil {
+		return Summary{}, err
+	}
+	var summary Summary
+	var errs []error
+	for _, key := range req.Keys {
+		rec, err := headSource(ctx, client, req.Bucket, key, "")
+		var result RecordResult
+		if err != nil {
+			result, err = failedRecord(objectRecord{Bucket: req.Bucket, Key: key}, err)
+		} else {
+			result, err = attemptRecord(ctx, client, cfg, rec)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		summary.add(result)
+	}
+	return summary, errors.Join(errs...)
+}
+
+// headSource fills in what an S3 event would have carried, so the new
+// manifest records the source's ETag and version like any other, and a later
+// redelivery of the upload's own event is still skipped. A non-empty
+// versionID looks up that version, and the record then names it, so the
+// download fetches those bytes even if the key has been overwritten since.
+func headSource(ctx context.Context, client s3API, bucket, key, versionID string) (objectRecord, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	head, err := client.HeadObject(ctx, input)
+	if err != nil {
+		return objectRecord{}, fmt.Errorf("looking up the source: %w", err)
+	}
+	return objectRecord{
+		Bucket: bucket,
+		Key:    key,
+		Size:   aws.ToInt64(head.ContentLength),
+		// HeadObject quotes the ETag; event notifications do not.
+		ETag:      strings.Trim(aws.ToString(head.ETag), `"`),
+		VersionID: cmp.Or(aws.ToString(head.VersionId), versionID),
+	}, nil
+}
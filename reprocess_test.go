@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseReprocessRequest(t *testing.T) {
+	req, err := parseReprocessRequest([]byte(`{"action":"reprocess","bucket":"src","keys":["a/b.jpg"],
+		"overrides":{"dims":"300:300,225","formats":"webp"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReprocessRequest{Action: "reprocess", Bucket: "src", Keys: []string{"a/b.jpg"},
+		Overrides: ReprocessOverrides{Dims: "300:300,225", Formats: "webp"}}
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("got %+v, want %+v", req, want)
+	}
+	// A misspelt override must not silently fall back to the current settings.
+	if _, err := parseReprocessRequest([]byte(`{"action":"reprocess","bucket":"src","keys":["a/b.jpg"],
+		"overrides":{"dimensions":"300:300,225"}}`)); err == nil {
+		t.Error("accepted an unknown override")
+	}
+}
+
+func TestReprocessRequestApply(t *testing.T) {
+	base := settings{destinationBucket: "dest", dims: getDefaultDims(), formats: getDefaultImageTypes(), thumbSize: 64}
+	valid := ReprocessRequest{Action: actionReprocess, Bucket: "src", Keys: []string{"a/b.jpg"}}
+	for _, tc := range []struct {
+		name    string
+		edit    func(*ReprocessRequest)
+		wantErr string
+	}{
+		{"valid", func(*ReprocessRequest) {}, ""},
+		{"unknown action", func(r *ReprocessRequest) { r.Action = "purge" }, "unknown action"},
+		{"no bucket", func(r *ReprocessRequest) { r.Bucket = "" }, "no bucket"},
+		{"no keys", func(r *ReprocessRequest) { r.Keys = nil }, "no keys"},
+		{"directory key", func(r *ReprocessRequest) { r.Keys = append(r.Keys, "a/") }, `key "a/"`},
+		{"bad dims", func(r *ReprocessRequest) { r.Overrides.Dims = "1200:wide" }, "overrides.dims"},
+		{"bad formats", func(r *ReprocessRequest) { r.Overrides.Formats = "gif" }, "overrides.formats"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := valid
+			req.Keys = append([]string(nil), valid.Keys...)
+			tc.edit(&req)
+			got, err := req.apply(base)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error %v, want one mentioning %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.force {
+				t.Error("reprocessing did not force")
+			}
+		})
+	}
+
+	req := valid
+	req.Overrides = ReprocessOverrides{Dims: "300:300,225", Formats: "webp"}
+	got, err := req.apply(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]ImageSize{"300": {300, 225}}; !reflect.DeepEqual(got.dims, want) {
+		t.Errorf("dims = %v, want %v", got.dims, want)
+	}
+	if want := []ImageFormat{FormatWEBP}; !reflect.DeepEqual(got.formats, want) {
+		t.Errorf("formats = %v, want %v", got.formats, want)
+	}
+	if len(base.dims) != len(getDefaultDims()) {
+		t.Error("apply modified the function's settings")
+	}
+}
+
+// TestHandleReprocess: listed keys are regenerated with the overrides even
+// though their sets are current, and a missing key fails on its own.
+func TestHandleReprocess(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{"tags/bread/orig.png": testPNG(t, 800, 600)}}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64}
+	rec, err := headSource(context.Background(), fake, "src", "tags/bread/orig.png", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handleRecord(context.Background(), fake, cfg, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := handleReprocess(context.Background(), fake, cfg, ReprocessRequest{
+		Action: actionReprocess, Bucket: "src",
+		Keys:      []string{"tags/bread/orig.png", "tags/pie/orig.png"},
+		Overrides: ReprocessOverrides{Dims: "300:300,225"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "s3://src/tags/pie/orig.png") {
+		t.Errorf("error %v does not name the missing key", err)
+	}
+	if summary.Processed != 1 || summary.Failed != 1 {
+		t.Errorf("summary = %+v, want 1 processed and 1 failed", summary)
+	}
+	if fake.bodies["tags/bread/300.webp"] == nil {
+		t.Error("the override's 300.webp was not generated")
+	}
+	m, err := parseManifest(fake.bodies["tags/bread/manifest.json"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Source.ETag != "etag-tags/bread/orig.png" {
+		t.Errorf("manifest source ETag = %q, want the unquoted source ETag", m.Source.ETag)
+	}
+
+	// Validation comes before any work.
+	puts := len(fake.puts)
+	if _, err := handleReprocess(context.Background(), fake, cfg, ReprocessRequest{
+		Action: actionReprocess, Bucket: "src", Keys: []string{"tags/bread/orig.png"},
+		Overrides: ReprocessOverrides{Formats: "tiff"},
+	}); err == nil {
+		t.Error("accepted an invalid override")
+	}
+	if len(fake.puts) != puts {
+		t.Error("an invalid request uploaded files")
+	}
+}
@@ -34,13 +34,14 @@ func resizeTo(src image.Image, w, h int) *image.RGBA {
 		iw := int(float64(b.Dx()) / ratio * preShrinkThreshold)
 		ih := int(float64(b.Dy()) / ratio * preShrinkThreshold)
 		if iw > w && ih > h {
-			mid := image.NewRGBA(image.Rect(0, 0, iw, ih))
+			mid := newRGBA(image.Rect(0, 0, iw, ih))
+			defer releaseImage(mid)
 			draw.ApproxBiLinear.Scale(mid, mid.Bounds(), src, b, draw.Src, nil)
 			src, b = mid, mid.Bounds()
 		}
 	}
 
-	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	dst := newRGBA(image.Rect(0, 0, w, h))
 	resampler.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
 	return dst
 }
@@ -56,7 +57,7 @@ func resizeTo(src image.Image, w, h int) *image.RGBA {
 // If src is already opaque this is a straight copy.
 func flatten(src image.Image) *image.RGBA {
 	b := src.Bounds()
-	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	dst := newRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
 
 	if op, ok := src.(interface{ Opaque() bool }); ok && op.Opaque() {
 		draw.Copy(dst, image.Point{}, src, b, draw.Src, nil)
@@ -90,6 +91,7 @@ func coverCrop(src image.Image, size int) *image.RGBA {
 	scaledH := roundFloat(float64(inH) / factor)
 
 	scaled := resizeTo(src, scaledW, scaledH)
+	defer releaseImage(scaled)
 
 	left := (scaledW - size + 1) / 2
 	top := (scaledH - size + 1) / 2
@@ -101,11 +103,40 @@ func coverCrop(src image.Image, size int) *image.RGBA {
 	}
 	cropW, cropH := min(size, scaledW), min(size, scaledH)
 
-	dst := image.NewRGBA(image.Rect(0, 0, cropW, cropH))
+	dst := newRGBA(image.Rect(0, 0, cropW, cropH))
 	draw.Copy(dst, image.Point{}, scaled, image.Rect(left, top, left+cropW, top+cropH), draw.Src, nil)
 	return dst
 }
 
+// coverBox fills a w x h box: it takes the largest centred region of src
+// with the box's aspect ratio and scales it to the box. Unlike coverCrop it
+// never upscales; a source smaller than the box yields the region at its own
+// size, in the box's proportions.
+func coverBox(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	inW, inH := b.Dx(), b.Dy()
+	if w <= 0 || h <= 0 || inW == 0 || inH == 0 {
+		return image.NewRGBA(image.Rect(0, 0, 0, 0))
+	}
+
+	cropW, cropH := inW, inH
+	if inW*h > inH*w {
+		cropW = max(1, roundFloat(float64(inH)*float64(w)/float64(h)))
+	} else {
+		cropH = max(1, roundFloat(float64(inW)*float64(h)/float64(w)))
+	}
+	left := b.Min.X + (inW-cropW)/2
+	top := b.Min.Y + (inH-cropH)/2
+	region := image.Rect(left, top, left+cropW, top+cropH)
+
+	if cropW < w || cropH < h {
+		w, h = cropW, cropH
+	}
+	dst := newRGBA(image.Rect(0, 0, w, h))
+	resampler.Scale(dst, dst.Bounds(), src, region, draw.Src, nil)
+	return dst
+}
+
 // roundFloat matches libvips' rounding (floor(x + 0.5)).
 func roundFloat(f float64) int {
 	return int(math.Floor(f + 0.5))
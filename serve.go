@@ -0,0 +1,450 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// runServe serves /resize URLs on addr, reading sources from source: a local
+// directory, or s3://bucket/prefix. endpoint points the S3 client at an
+// S3-compatible service such as MinIO. Resizes are cached in cacheDir, or in
+// cacheMB of memory when it is empty.
+func runServe(ctx context.Context, addr, source, endpoint, cacheDir string, cacheMB int) error {
+	limits, err := loadLimits()
+	if err != nil {
+		return err
+	}
+	var store sourceStore
+	if rest, ok := strings.CutPrefix(source, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if bucket == "" {
+			return fmt.Errorf("%q has no bucket name", source)
+		}
+		awsCfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return fmt.Errorf("AWS configuration: %w", err)
+		}
+		client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+			if endpoint != "" {
+				// Self-hosted S3 services rarely have per-bucket hostnames.
+				o.BaseEndpoint = aws.String(endpoint)
+				o.UsePathStyle = true
+			}
+		})
+		store = &s3Store{client: client, bucket: bucket, prefix: strings.TrimSuffix(prefix, "/")}
+	} else {
+		if store, err = newDirStore(source); err != nil {
+			return err
+		}
+	}
+
+	var cache resultCache = newMemoryCache(cacheMB << 20)
+	if cacheDir != "" {
+		if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+			return fmt.Errorf("creating cache directory %s: %w", cacheDir, err)
+		}
+		cache = dirCache{dir: cacheDir}
+	}
+
+	srv := newResizeServer(store, cache, limits, runtime.GOMAXPROCS(0))
+	fmt.Printf("Serving %s on %s\n", source, addr)
+	return newHTTPServer(addr, srv.routes()).ListenAndServe()
+}
+
+// Timeouts of the resize server. Requests are bodiless GETs, so reading one
+// is quick; writing covers waiting for a render slot and the render itself.
+const (
+	serveReadHeaderTimeout = 5 * time.Second
+	serveReadTimeout       = 10 * time.Second
+	serveWriteTimeout      = 60 * time.Second
+	serveIdleTimeout       = 2 * time.Minute
+)
+
+// newHTTPServer bounds how long a client can hold a connection, so slow or
+// stalled ones cannot pile up and keep the render slots busy.
+func newHTTPServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: serveReadHeaderTimeout,
+		ReadTimeout:       serveReadTimeout,
+		WriteTimeout:      serveWriteTimeout,
+		IdleTimeout:       serveIdleTimeout,
+	}
+}
+
+// serveCacheControl is set on every resize. A URL names a source key, not its
+// content, so a replaced source is only picked up once caches revalidate; the
+// ETag does change with the source.
+const serveCacheControl = "public, max-age=86400"
+
+// Fit modes of a resize.
+const (
+	fitContain = "contain" // within the box, keeping the aspect ratio
+	fitCover   = "cover"   // filling the box, cropping the overflow
+)
+
+// resizeOptions are the processing options of a /resize URL, e.g.
+// "w=400,h=300,fit=cover,fmt=webp,q=80".
+type resizeOptions struct {
+	width, height int
+	fit           string
+	format        ImageFormat
+	quality       int
+}
+
+// parseResizeOptions reads the comma-separated options of a /resize URL. A
+// width or height is required, and a cover fit needs both. The format
+// defaults to JPEG and the quality to that of the pre-generated sets.
+func parseResizeOptions(s string) (resizeOptions, error) {
+	o := resizeOptions{fit: fitContain, format: FormatJPEG, quality: defaultQuality}
+	seen := map[string]bool{}
+	for _, opt := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(opt, "=")
+		if !ok || v == "" {
+			return o, fmt.Errorf("option %q is not key=value", opt)
+		}
+		if seen[k] {
+			return o, fmt.Errorf("option %s given twice", k)
+		}
+		seen[k] = true
+		var err error
+		switch k {
+		case "w":
+			o.width, err = positiveInt(k, v)
+		case "h":
+			o.height, err = positiveInt(k, v)
+		case "q":
+			if o.quality, err = positiveInt(k, v); err == nil && o.quality > 100 {
+				err = fmt.Errorf("q: %d is over 100", o.quality)
+			}
+		case "fit":
+			if v != fitContain && v != fitCover {
+				err = fmt.Errorf("fit: %q is not %s or %s", v, fitContain, fitCover)
+			}
+			o.fit = v
+		case "fmt":
+			o.format, err = getImageType(v)
+		default:
+			err = fmt.Errorf("unknown option %q (supported: w, h, fit, fmt, q)", k)
+		}
+		if err != nil {
+			return o, err
+		}
+	}
+	if o.width == 0 && o.height == 0 {
+		return o, errors.New("w or h is required")
+	}
+	if o.fit == fitCover && (o.width == 0 || o.height == 0) {
+		return o, errors.New("fit=cover needs both w and h")
+	}
+	return o, nil
+}
+
+func positiveInt(name, v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s: invalid value %q", name, v)
+	}
+	return n, nil
+}
+
+// String is the canonical form of the options, so equivalent URLs share a
+// cache entry.
+func (o resizeOptions) String() string {
+	return fmt.Sprintf("w=%d,h=%d,fit=%s,fmt=%v,q=%d", o.width, o.height, o.fit, o.format, o.quality)
+}
+
+// render resizes a decoded source as the options ask. Like the pre-generated
+// sets it flattens alpha onto white and never upscales.
+func (o resizeOptions) render(src image.Image) ([]byte, error) {
+	base := flatten(src)
+	defer releaseImage(base)
+	size := ImageSize{Width: base.Bounds().Dx(), Height: base.Bounds().Dy()}
+
+	out := base
+	if o.fit == fitCover {
+		out = coverBox(base, o.width, o.height)
+		defer releaseImage(out)
+	} else {
+		// A missing side does not constrain.
+		box := ImageSize{Width: o.width, Height: o.height}
+		if box.Width == 0 {
+			box.Width = size.Width
+		}
+		if box.Height == 0 {
+			box.Height = size.Height
+		}
+		if d := smartDims(size, box); d != size {
+			out = resizeTo(base, d.Width, d.Height)
+			defer releaseImage(out)
+		}
+	}
+	return encode(out, o.format, o.quality)
+}
+
+// sourceStore is where the server reads sources from. A missing key is an
+// error that errorStatus maps to 404.
+type sourceStore interface {
+	// version identifies the key's current content, so a replaced source
+	// misses the cache.
+	version(ctx context.Context, key string) (string, error)
+	read(ctx context.Context, key string) ([]byte, error)
+}
+
+// dirStore reads sources from a local directory. Keys cannot reach outside
+// it, through ".." or symlinks.
+type dirStore struct {
+	root *os.Root
+}
+
+func newDirStore(dir string) (*dirStore, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, fmt.Errorf("opening source directory: %w", err)
+	}
+	return &dirStore{root: root}, nil
+}
+
+func (d *dirStore) version(_ context.Context, key string) (string, error) {
+	fi, err := d.root.Stat(key)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return "", fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size()), nil
+}
+
+func (d *dirStore) read(_ context.Context, key string) ([]byte, error) {
+	return d.root.ReadFile(key)
+}
+
+// s3Store reads sources from a bucket, under an optional key prefix. The
+// client can point at any S3-compatible endpoint.
+type s3Store struct {
+	client s3API
+	bucket string
+	prefix string
+}
+
+func (s *s3Store) version(ctx context.Context, key string) (string, error) {
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(objectKey(s.prefix, key)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("looking up s3://%s/%s: %w", s.bucket, objectKey(s.prefix, key), err)
+	}
+	return aws.ToString(head.ETag), nil
+}
+
+func (s *s3Store) read(ctx context.Context, key string) ([]byte, error) {
+	return downloadImage(ctx, s.client, s.bucket, objectKey(s.prefix, key))
+}
+
+// resultCache holds rendered resizes. Caching is best-effort, so neither
+// method reports errors.
+type resultCache interface {
+	get(key string) ([]byte, bool)
+	put(key string, data []byte)
+}
+
+// memoryCache is a least-recently-used cache bounded by the bytes it holds.
+type memoryCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	order    *list.List // front is most recent
+	entries  map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	data []byte
+}
+
+func newMemoryCache(maxBytes int) *memoryCache {
+	return &memoryCache{maxBytes: maxBytes, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *memoryCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).data, true
+}
+
+func (c *memoryCache) put(key string, data []byte) {
+	if len(data) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.size -= len(e.Value.(*cacheEntry).data)
+		c.order.Remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, data})
+	c.size += len(data)
+	for c.size > c.maxBytes {
+		e := c.order.Back()
+		c.order.Remove(e)
+		old := e.Value.(*cacheEntry)
+		delete(c.entries, old.key)
+		c.size -= len(old.data)
+	}
+}
+
+// dirCache keeps resizes as files in a directory, so they survive restarts.
+// Nothing is evicted; the directory can be emptied at any time.
+type dirCache struct {
+	dir string
+}
+
+func (c dirCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+func (c dirCache) get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(c.path(key))
+	return data, err == nil
+}
+
+// put writes through a temporary file, so a concurrent get never reads a
+// partial one.
+func (c dirCache) put(key string, data []byte) {
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: caching: %v\n", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Fprintf(os.Stderr, "Warning: caching: %v\n", err)
+	}
+}
+
+// resizeServer answers /resize/{options}/{source key}.
+type resizeServer struct {
+	store  sourceStore
+	cache  resultCache
+	limits decodeLimits
+
+	// renders bounds concurrent decodes, the memory-hungry part.
+	renders chan struct{}
+}
+
+func newResizeServer(store sourceStore, cache resultCache, limits decodeLimits, concurrency int) *resizeServer {
+	return &resizeServer{store: store, cache: cache, limits: limits, renders: make(chan struct{}, concurrency)}
+}
+
+func (s *resizeServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /resize/{options}/{key...}", s.handleResize)
+	return mux
+}
+
+func (s *resizeServer) handleResize(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	opts, err := parseResizeOptions(r.PathValue("options"))
+	if err != nil {
+		serveError(w, http.StatusBadRequest, err)
+		return
+	}
+	key := r.PathValue("key")
+	if !fs.ValidPath(key) || key == "." {
+		serveError(w, http.StatusBadRequest, fmt.Errorf("bad source key %q", key))
+		return
+	}
+	version, err := s.store.version(ctx, key)
+	if err != nil {
+		serveError(w, errorStatus(err), err)
+		return
+	}
+	cacheKey := opts.String() + "/" + key + "@" + version
+	sum := sha256.Sum256([]byte(cacheKey))
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", serveCacheControl)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, ok := s.cache.get(cacheKey)
+	if !ok {
+		if data, err = s.resize(ctx, key, opts); err != nil {
+			w.Header().Del("ETag")
+			w.Header().Del("Cache-Control")
+			serveError(w, errorStatus(err), err)
+			return
+		}
+		s.cache.put(cacheKey, data)
+	}
+	w.Header().Set("Content-Type", opts.format.ContentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// resize renders one source under the same decode limits as the Lambda.
+func (s *resizeServer) resize(ctx context.Context, key string, opts resizeOptions) ([]byte, error) {
+	select {
+	case s.renders <- struct{}{}:
+		defer func() { <-s.renders }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	data, err := s.store.read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := decodeImage(data, s.limits)
+	if err != nil {
+		return nil, &decodeError{key, err}
+	}
+	defer releaseImage(img)
+	out, err := opts.render(img)
+	if err != nil {
+		return nil, fmt.Errorf("resizing %s: %w", key, err)
+	}
+	return out, nil
+}
+
+func serveError(w http.ResponseWriter, code int, err error) {
+	if code >= 500 {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	http.Error(w, err.Error(), code)
+}
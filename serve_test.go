@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseResizeOptions(t *testing.T) {
+	for _, tc := range []struct {
+		raw     string
+		want    string // canonical form
+		wantErr string
+	}{
+		{"w=400", "w=400,h=0,fit=contain,fmt=jpeg,q=75", ""},
+		{"w=400,h=300,fit=cover,fmt=webp", "w=400,h=300,fit=cover,fmt=webp,q=75", ""},
+		{"fmt=png,h=200,q=90", "w=0,h=200,fit=contain,fmt=png,q=90", ""},
+		{"fmt=jpg,w=10", "w=10,h=0,fit=contain,fmt=jpeg,q=75", ""},
+		{"fmt=webp", "", "w or h"},
+		{"w=400,fit=cover", "", "both w and h"},
+		{"w=0", "", "invalid value"},
+		{"w=-5", "", "invalid value"},
+		{"w=400,q=101", "", "over 100"},
+		{"w=400,fit=fill", "", "fit"},
+		{"w=400,fmt=gif", "", "unsupported output format"},
+		{"w=400,w=300", "", "twice"},
+		{"w=400,blur=3", "", "unknown option"},
+		{"w400", "", "key=value"},
+	} {
+		t.Run(tc.raw, func(t *testing.T) {
+			o, err := parseResizeOptions(tc.raw)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error %v, want one mentioning %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil || o.String() != tc.want {
+				t.Errorf("got %s, %v, want %s", o, err, tc.want)
+			}
+		})
+	}
+}
+
+// countingStore counts reads, to tell cache hits from renders.
+type countingStore struct {
+	sourceStore
+	reads int
+}
+
+func (c *countingStore) read(ctx context.Context, key string) ([]byte, error) {
+	c.reads++
+	return c.sourceStore.read(ctx, key)
+}
+
+func newTestServer(t *testing.T, cache resultCache) (*httptest.Server, *countingStore, string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "tags", "my bread"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tags", "my bread", "orig.png"), testPNG(t, 800, 600), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a photo"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := newDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countingStore{sourceStore: ds}
+	srv := httptest.NewServer(newResizeServer(store, cache, decodeLimits{}, 2).routes())
+	t.Cleanup(srv.Close)
+	return srv, store, dir
+}
+
+// TestResizeServer: resizes decode to the requested geometry and format, and
+// a repeat is served from the cache.
+func TestResizeServer(t *testing.T) {
+	srv, store, _ := newTestServer(t, newMemoryCache(1<<20))
+	for _, tc := range []struct {
+		path         string
+		wantType     string
+		wantW, wantH int
+	}{
+		{"/resize/w=400/tags/my%20bread/orig.png", "image/jpeg", 400, 300},
+		{"/resize/h=150,fmt=png/tags/my%20bread/orig.png", "image/png", 200, 150},
+		{"/resize/w=200,h=200,fit=cover,fmt=webp/tags/my%20bread/orig.png", "image/webp", 200, 200},
+		{"/resize/w=2000/tags/my%20bread/orig.png", "image/jpeg", 800, 600}, // never upscaled
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != tc.wantType {
+				t.Fatalf("got %d %s, want 200 %s", resp.StatusCode, resp.Header.Get("Content-Type"), tc.wantType)
+			}
+			cfg, _, err := image.DecodeConfig(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != tc.wantW || cfg.Height != tc.wantH {
+				t.Errorf("got %dx%d, want %dx%d", cfg.Width, cfg.Height, tc.wantW, tc.wantH)
+			}
+		})
+	}
+
+	reads := store.reads
+	resp, err := http.Get(srv.URL + "/resize/w=400,fmt=jpeg,q=75/tags/my%20bread/orig.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || store.reads != reads {
+		t.Errorf("equivalent URL: got %d after %d reads, want 200 from the cache", resp.StatusCode, store.reads-reads)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/resize/w=400/tags/my%20bread/orig.png", nil)
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match: got %v, %v, want 304", resp.StatusCode, err)
+	}
+}
+
+func TestResizeServerErrors(t *testing.T) {
+	srv, _, _ := newTestServer(t, newMemoryCache(1<<20))
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/resize/w=400/tags/pie/orig.png", 404},
+		{"/resize/w=400/tags", 404}, // a directory
+		{"/resize/blur=3/tags/my%20bread/orig.png", 400},
+		{"/resize/w=400/notes.txt", 422},
+	} {
+		resp, err := http.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("GET %s = %d, want %d", tc.path, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+// TestHTTPServerTimeouts: a slow client must not hold a connection forever.
+func TestHTTPServerTimeouts(t *testing.T) {
+	srv := newHTTPServer(":0", http.NotFoundHandler())
+	if srv.ReadHeaderTimeout <= 0 || srv.ReadTimeout <= 0 || srv.WriteTimeout <= 0 || srv.IdleTimeout <= 0 {
+		t.Errorf("timeouts %v, %v, %v, %v; want all set",
+			srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+}
+
+// TestDirStoreStaysInside: a key cannot read outside the source directory.
+func TestDirStoreStaysInside(t *testing.T) {
+	parent := t.TempDir()
+	if err := os.WriteFile(filepath.Join(parent, "secret.png"), testPNG(t, 10, 10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(parent, "src")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(parent, "secret.png"), filepath.Join(dir, "link.png")); err != nil {
+		t.Skip(err)
+	}
+	store, err := newDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"../secret.png", "link.png"} {
+		if _, err := store.read(context.Background(), key); err == nil {
+			t.Errorf("read(%q) escaped the source directory", key)
+		}
+	}
+}
+
+func TestMemoryCacheEvicts(t *testing.T) {
+	c := newMemoryCache(10)
+	c.put("a", bytes.Repeat([]byte("a"), 4))
+	c.put("b", bytes.Repeat([]byte("b"), 4))
+	c.get("a") // b is now the least recently used
+	c.put("c", bytes.Repeat([]byte("c"), 4))
+	if _, ok := c.get("b"); ok {
+		t.Error("b survived, want it evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.get(k); !ok {
+			t.Errorf("%s was evicted", k)
+		}
+	}
+	c.put("big", bytes.Repeat([]byte("x"), 11))
+	if _, ok := c.get("big"); ok || c.size > 10 {
+		t.Errorf("an entry over the limit was cached (size %d)", c.size)
+	}
+}
+
+func TestDirCache(t *testing.T) {
+	c := dirCache{dir: t.TempDir()}
+	if _, ok := c.get("k"); ok {
+		t.Fatal("hit on an empty cache")
+	}
+	c.put("k", []byte("data"))
+	if got, ok := c.get("k"); !ok || string(got) != "data" {
+		t.Errorf("get = %q, %v, want data", got, ok)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// SQSHandler processes S3 notifications delivered through an SQS queue, which
+// adds retries and a dead-letter queue in front of the optimizer. Each message
+// succeeds or fails on its own: the response lists only the failed messages,
+// so SQS redelivers those and deletes the rest. The event source mapping must
+// have ReportBatchItemFailures enabled, or the response is ignored and any
+// error redelivers the whole batch.
+func SQSHandler(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	cfg, client, err := setup(ctx)
+	if err != nil {
+		// Nothing in the batch can succeed; fail it whole.
+		return events.SQSEventResponse{}, err
+	}
+	return handleSQS(ctx, client, cfg, event), nil
+}
+
+func handleSQS(ctx context.Context, client s3API, cfg settings, event events.SQSEvent) events.SQSEventResponse {
+	var resp events.SQSEventResponse
+	for _, msg := range event.Records {
+		if err := handleMessage(ctx, client, cfg, msg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: message %s: %v\n", msg.MessageId, err)
+			resp.BatchItemFailures = append(resp.BatchItemFailures,
+				events.SQSBatchItemFailure{ItemIdentifier: msg.MessageId})
+		}
+	}
+	return resp
+}
+
+// handleMessage processes the notification in one message body: an S3
+// notification, or an EventBridge event when a rule targets the queue. S3's
+// s3:TestEvent, sent when the notification is configured, holds no records
+// and is acknowledged. One notification normally holds one record; like
+// handleS3Event, every record is attempted and the message fails if any did,
+// with their errors joined. On redelivery the records that succeeded are
+// skipped as unchanged.
+func handleMessage(ctx context.Context, client s3API, cfg settings, msg events.SQSMessage) error {
+	records, err := parseNotification([]byte(msg.Body))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, record := range records {
+		if err := handleRecord(ctx, client, cfg, record); err != nil {
+			errs = append(errs, fmt.Errorf("s3://%s/%s: %w", record.Bucket, record.Key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func sqsMessage(t *testing.T, id string, keys ...string) events.SQSMessage {
+	t.Helper()
+	var event events.S3Event
+	for _, k := range keys {
+		rec := events.S3EventRecord{EventSource: "aws:s3"}
+		rec.S3.Bucket.Name = "src"
+		rec.S3.Object.Key = k
+		event.Records = append(event.Records, rec)
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events.SQSMessage{MessageId: id, Body: string(body)}
+}
+
+// TestHandleSQS: only the messages that failed are reported, so SQS
+// redelivers those alone.
+func TestHandleSQS(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{
+		"tags/bread/orig.png": testPNG(t, 800, 600),
+		"tags/cake/orig.png":  testPNG(t, 800, 600),
+		"tags/soup/orig.png":  []byte("not an image"),
+		"tags/tart/orig.png":  testPNG(t, 800, 600),
+	}}
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64}
+	event := events.SQSEvent{Records: []events.SQSMessage{
+		sqsMessage(t, "good", "tags/bread/orig.png"),
+		sqsMessage(t, "garbage", "tags/soup/orig.png"),
+		{MessageId: "malformed", Body: "{not json"},
+		{MessageId: "test-event", Body: `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"src"}`},
+		sqsMessage(t, "missing", "tags/pie/orig.png"),
+		sqsMessage(t, "also-good", "tags/cake/orig.png"),
+		// The bad record comes first and must not stop the good one.
+		sqsMessage(t, "mixed", "tags/soup/orig.png", "tags/tart/orig.png"),
+	}}
+
+	resp := handleSQS(context.Background(), fake, cfg, event)
+	var failed []string
+	for _, f := range resp.BatchItemFailures {
+		failed = append(failed, f.ItemIdentifier)
+	}
+	if want := []string{"garbage", "malformed", "missing", "mixed"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed messages = %v, want %v", failed, want)
+	}
+	for _, key := range []string{"tags/bread/manifest.json", "tags/cake/manifest.json", "tags/tart/manifest.json"} {
+		if fake.bodies[key] == nil {
+			t.Errorf("%s was not uploaded", key)
+		}
+	}
+}
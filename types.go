@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
 )
@@ -21,6 +22,12 @@ const (
 	FormatJPEG
 	FormatWEBP
 	FormatPNG
+
+	// FormatJSON and FormatHTML are not image formats: they are the metadata
+	// files (meta.json, picture.html) that travel alongside the images.
+	// getImageType never returns them.
+	FormatJSON
+	FormatHTML
 )
 
 // String returns the file extension for the format. buildPath formats an
@@ -33,6 +40,10 @@ func (f ImageFormat) String() string {
 		return "webp"
 	case FormatPNG:
 		return "png"
+	case FormatJSON:
+		return "json"
+	case FormatHTML:
+		return "html"
 	}
 	return "unknown"
 }
@@ -47,10 +58,19 @@ func (f ImageFormat) ContentType() string {
 		return "image/webp"
 	case FormatPNG:
 		return "image/png"
+	case FormatJSON:
+		return "application/json"
+	case FormatHTML:
+		return "text/html; charset=utf-8"
 	}
 	return "application/octet-stream"
 }
 
+// isImage is false for the metadata formats.
+func (f ImageFormat) isImage() bool {
+	return f != FormatJSON && f != FormatHTML
+}
+
 // getImageType maps an extension from FORMATS/--formats to an output format.
 // The previous implementation also accepted tiff, gif, pdf, svg, magick, heif
 // and avif; those were transcribed from bimg's enum rather than being real
@@ -73,10 +93,31 @@ type Derivative struct {
 	Name   string // "orig", "thumbnail", "1200", ...
 	Format ImageFormat
 	Data   []byte
+
+	// Width, Height and Quality describe an image derivative for the
+	// manifest. They are zero for the JSON files.
+	Width   int
+	Height  int
+	Quality int
+
+	// Metadata is sent as S3 user metadata (x-amz-meta-*) on upload.
+	Metadata map[string]string
+
+	// Hash, when set, is a short content hash placed in the file name. See
+	// hashFilenames.
+	Hash string
+
+	// Key is the destination object key, set by assignKeys. It is empty on
+	// the command line, which writes Filename into a directory.
+	Key string
 }
 
-// Filename is the object/file name for this derivative, e.g. "1200.webp".
+// Filename is the object/file name for this derivative, e.g. "1200.webp", or
+// "1200.3fa2c1.webp" with a content hash.
 func (d Derivative) Filename() string {
+	if d.Hash != "" {
+		return fmt.Sprintf("%s.%s.%v", d.Name, d.Hash, d.Format)
+	}
 	return fmt.Sprintf("%s.%v", d.Name, d.Format)
 }
 
@@ -85,6 +126,52 @@ func (d Derivative) ContentType() string {
 	return d.Format.ContentType()
 }
 
+// Analysis is what processImage measured about the image, as opposed to the
+// files it produced.
+type Analysis struct {
+	Width   int           `json:"width"` // the oriented original
+	Height  int           `json:"height"`
+	Quality QualityScores `json:"quality"`
+
+	// BlurHash and ThumbHash are placeholders the site can paint before the
+	// <picture> loads. ThumbHash is base64 (standard alphabet, padded).
+	BlurHash  string `json:"blurhash"`
+	ThumbHash string `json:"thumbhash"`
+
+	// LQIP is a tiny, heavily compressed copy of the image as a data URI, to
+	// inline in <img src> and blur with CSS. It is too large for S3 metadata.
+	LQIP string `json:"lqip"`
+
+	// Palette is up to five colours, most populous first. Dominant repeats
+	// the first, for sites that only want a background.
+	Dominant Swatch   `json:"dominant"`
+	Palette  []Swatch `json:"palette"`
+
+	// PHash is the 64-bit perceptual hash as 16 hex digits. Near-duplicates
+	// differ in only a few bits; see hammingDistance.
+	PHash string `json:"phash"`
+}
+
+// metadata is the S3 user metadata describing the analysis, attached to
+// orig.jpeg so it can be read with a HEAD request.
+func (a Analysis) metadata() map[string]string {
+	m := a.Quality.metadata()
+	m["nnr-blurhash"] = a.BlurHash
+	m["nnr-thumbhash"] = a.ThumbHash
+	m["nnr-phash"] = a.PHash
+	for k, v := range paletteMetadata(a.Palette) {
+		m[k] = v
+	}
+	return m
+}
+
+// metaDerivative renders the analysis as meta.json. processImage does not
+// emit it itself, so that its output stays exactly the image set.
+func metaDerivative(a Analysis) Derivative {
+	data, _ := json.MarshalIndent(a, "", "  ") // plain fields: cannot fail
+	return Derivative{Name: "meta", Format: FormatJSON, Data: append(data, '\n')}
+}
+
 // namedSize pairs a breakpoint name with its maximum box.
 type namedSize struct {
 	Name string
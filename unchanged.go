@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3 delivers events at least once and backfills replay them, so the same
+// upload often arrives twice. manifest.json is written last and carries the
+// source's ETag and version ID as user metadata, so a single HeadObject tells
+// whether the complete set was already generated from this exact object.
+const (
+	sourceETagMetadata    = "nnr-source-etag"
+	sourceVersionMetadata = "nnr-source-version"
+)
+
+// sourceMetadata is the fingerprint stored on manifest.json.
+func sourceMetadata(obj objectRecord) map[string]string {
+	m := map[string]string{}
+	if obj.ETag != "" {
+		m[sourceETagMetadata] = obj.ETag
+	}
+	if obj.VersionID != "" {
+		m[sourceVersionMetadata] = obj.VersionID
+	}
+	return m
+}
+
+// sameSource reports whether stored, the metadata of an existing manifest,
+// was written for obj. The version ID decides when both sides have one, since
+// re-uploading identical bytes gives a new version with the same ETag;
+// otherwise the ETag does. An event without either never matches.
+func sameSource(stored map[string]string, obj objectRecord) bool {
+	if v := stored[sourceVersionMetadata]; v != "" && obj.VersionID != "" {
+		return v == obj.VersionID
+	}
+	return obj.ETag != "" && stored[sourceETagMetadata] == obj.ETag
+}
+
+// alreadyProcessed reports whether the manifest in dir was generated from obj.
+// A missing manifest is not an error: the set has not been generated yet.
+func alreadyProcessed(ctx context.Context, client s3API, bucket, dir string, obj objectRecord) (bool, error) {
+	return writtenFor(ctx, client, bucket, objectKey(dir, manifestName+".json"), obj)
+}
+
+// alreadyRejected reports whether the rejection report in dir was written for
+// obj, which a retry would only reject again.
+func alreadyRejected(ctx context.Context, client s3API, bucket, dir string, obj objectRecord) (bool, error) {
+	return writtenFor(ctx, client, bucket, objectKey(dir, rejectionReport), obj)
+}
+
+// writtenFor reports whether key exists and carries obj's fingerprint.
+func writtenFor(ctx context.Context, client s3API, bucket, key string, obj objectRecord) (bool, error) {
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	var missing *types.NotFound
+	if errors.As(err, &missing) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("checking s3://%s/%s: %w", bucket, key, err)
+	}
+	return sameSource(head.Metadata, obj), nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSameSource(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		stored map[string]string
+		obj    objectRecord
+		want   bool
+	}{
+		{"same etag", map[string]string{sourceETagMetadata: "abc"}, objectRecord{ETag: "abc"}, true},
+		{"new etag", map[string]string{sourceETagMetadata: "abc"}, objectRecord{ETag: "def"}, false},
+		{"no etag in event", map[string]string{sourceETagMetadata: "abc"}, objectRecord{}, false},
+		{"nothing stored", nil, objectRecord{ETag: "abc"}, false},
+		{"empty both", map[string]string{}, objectRecord{}, false},
+		{"same version",
+			map[string]string{sourceETagMetadata: "abc", sourceVersionMetadata: "v1"},
+			objectRecord{ETag: "abc", VersionID: "v1"}, true},
+		// Identical bytes uploaded again: same ETag, new version.
+		{"new version same etag",
+			map[string]string{sourceETagMetadata: "abc", sourceVersionMetadata: "v1"},
+			objectRecord{ETag: "abc", VersionID: "v2"}, false},
+		// Versioning turned on since the set was generated.
+		{"version only in event",
+			map[string]string{sourceETagMetadata: "abc"},
+			objectRecord{ETag: "abc", VersionID: "v2"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sameSource(tc.stored, tc.obj); got != tc.want {
+				t.Errorf("sameSource(%v, %+v) = %v, want %v", tc.stored, tc.obj, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestHandleRecordSkipsUnchanged: a redelivered event uploads nothing, while a
+// new ETag, FORCE, or a failed check processes the record as usual.
+func TestHandleRecordSkipsUnchanged(t *testing.T) {
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64}
+	record := func(etag string) objectRecord {
+		return objectRecord{Bucket: "src", Key: "tags/bread/orig.png", ETag: etag}
+	}
+
+	fake := &fakeS3{object: testPNG(t, 800, 600)}
+	if err := handleRecord(context.Background(), fake, cfg, record("abc")); err != nil {
+		t.Fatal(err)
+	}
+	first := len(fake.puts)
+	if got := fake.puts[first-1]; *got.Key != "tags/bread/manifest.json" || got.Metadata[sourceETagMetadata] != "abc" {
+		t.Fatalf("last upload %s has metadata %v, want the manifest with the source ETag", *got.Key, got.Metadata)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		etag    string
+		force   bool
+		headErr error
+		want    bool // reprocessed
+	}{
+		{"redelivered", "abc", false, nil, false},
+		{"changed", "def", false, nil, true},
+		{"forced", "abc", true, nil, true},
+		{"check failed", "abc", false, errors.New("AccessDenied"), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeS3{object: fake.object, puts: fake.puts[:first:first], headErr: tc.headErr}
+			c := cfg
+			c.force = tc.force
+			if err := handleRecord(context.Background(), f, c, record(tc.etag)); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(f.puts) > first; got != tc.want {
+				t.Errorf("reprocessed = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestHandleRecordSkipsRejected: a redelivered upload that was rejected is not
+// downloaded again, but a new upload to the folder is.
+func TestHandleRecordSkipsRejected(t *testing.T) {
+	cfg := settings{destinationBucket: "dest", dims: map[string]ImageSize{"400": {400, 300}},
+		formats: getDefaultImageTypes(), thumbSize: 64, rules: acceptRules{minWidth: 1000}}
+	fake := &fakeS3{object: testPNG(t, 800, 600)}
+	record := func(etag string) objectRecord {
+		return objectRecord{Bucket: "src", Key: "tags/bread/orig.png", ETag: etag}
+	}
+	if status, err := runRecord(context.Background(), fake, cfg, record("abc")); err != nil || status != statusRejected {
+		t.Fatalf("first run = %s, %v, want rejected", status, err)
+	}
+
+	fake.getErr = errors.New("downloaded")
+	if status, err := runRecord(context.Background(), fake, cfg, record("abc")); err != nil || status != statusRejected {
+		t.Errorf("redelivered = %s, %v, want rejected without a download", status, err)
+	}
+	if _, err := runRecord(context.Background(), fake, cfg, record("def")); err == nil {
+		t.Error("a changed source was not downloaded")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"time"
+)
+
+// warmupHEIC is a 1 KB, 640x480 HEIC (test_exif.heic from gen2brain/heic, MIT).
+// It only needs to be a real HEIC: decoding it forces wazero to compile the
+// embedded decoder module, which is the ~575 ms the first HEIC upload on a
+// cold container otherwise pays.
+//
+//go:embed assets/warmup.heic
+var warmupHEIC []byte
+
+// heicWarmupEnabled reads HEIC_WARMUP. It is off by default: a container that
+// only ever sees JPEGs would pay the compile for nothing. An unparseable value
+// is a configuration error, as for every other flag.
+func heicWarmupEnabled() (bool, error) {
+	return envBool("HEIC_WARMUP")
+}
+
+// warmUpHEIC decodes the embedded HEIC through the normal decode path. It runs
+// before lambda.Start, i.e. in the init phase, which is free on provisioned
+// concurrency and otherwise overlaps the rest of the cold start.
+func warmUpHEIC() (time.Duration, error) {
+	start := time.Now()
+	img, format, err := decodeImage(warmupHEIC, decodeLimits{})
+	if err != nil {
+		return time.Since(start), fmt.Errorf("decoding warm-up image: %w", err)
+	}
+	releaseImage(img)
+	if format != "heic" {
+		return time.Since(start), fmt.Errorf("warm-up image decoded as %s, want heic", format)
+	}
+	return time.Since(start), nil
+}